@@ -34,6 +34,8 @@ type StructureBower interface {
 	Atoms() [][]structure.Coords
 }
 
+// A SequenceBower corresponds to any value that can have a bag-of-words
+// computed from its primary structure (a sequence of amino acids).
 type SequenceBower interface {
 	// A global unique identifier for this value.
 	// (e.g., a sequence accession number.)
@@ -51,18 +53,138 @@ type SequenceBower interface {
 	Residues() [][]seq.Residue
 }
 
+// ComputeBOW computes a bag-of-words vector for the given value using any
+// kind of fragment library. 'bower' must implement StructureBower when 'lib'
+// is a structure fragment library, and SequenceBower when 'lib' is a sequence
+// fragment library. Otherwise, ComputeBOW will panic.
+func ComputeBOW(lib fragbag.Library, bower interface{}) BOW {
+	switch lib := lib.(type) {
+	case *fragbag.StructureLibrary:
+		if b, ok := bower.(StructureBower); ok {
+			return StructureBOW(lib, b)
+		}
+		panic(fmt.Sprintf("%T does not implement StructureBower, which is "+
+			"needed for the structure fragment library '%s'.", bower, lib))
+	case *fragbag.SequenceLibrary:
+		if b, ok := bower.(SequenceBower); ok {
+			return SequenceBOW(lib, b)
+		}
+		panic(fmt.Sprintf("%T does not implement SequenceBower, which is "+
+			"needed for the sequence fragment library '%s'.", bower, lib))
+	}
+	panic(fmt.Sprintf("Unrecognized fragment library type %T.", lib))
+}
+
+// StructureBOW computes a bag-of-words vector for the given value using
+// a structure fragment library. Each window of alpha-carbon atoms with
+// length equal to the fragment size contributes a single vote for the
+// fragment that best matches it.
+//
+// The BOW is derived from the assignments returned by StructureAssign.
 func StructureBOW(lib *fragbag.StructureLibrary, bower StructureBower) BOW {
+	return StructureAssign(lib, bower).BOW(lib.Size())
+}
+
+// Assignment corresponds to the best fragment found for a single window of
+// atoms in a StructureBower.
+type Assignment struct {
+	// The index of the region (in the list returned by Atoms) containing
+	// the window.
+	Region int
+
+	// The index of the first atom of the window in its region.
+	Start int
+
+	// The number of the best fragment for this window.
+	FragNumber int
+
+	// The RMSD between the window and the best fragment.
+	RMSD float64
+}
+
+func (a Assignment) String() string {
+	return fmt.Sprintf("%d:%d\t%d\t%0.4f", a.Region, a.Start, a.FragNumber,
+		a.RMSD)
+}
+
+// Assignments is a fragment "string": the best fragment for every window in
+// a StructureBower, ordered by region and then by the start of each window.
+type Assignments []Assignment
+
+// StructureAssign computes the best fragment for every window of alpha-carbon
+// atoms (with length equal to the fragment size) in the given value.
+// Windows never cross region boundaries, and regions smaller than the
+// fragment size have no windows. An empty library has no assignments.
+func StructureAssign(
+	lib *fragbag.StructureLibrary,
+	bower StructureBower,
+) Assignments {
+	var uplimit int
+
+	assigns := make(Assignments, 0)
+	if lib.Size() == 0 {
+		return assigns
+	}
+	libSize := lib.FragmentSize
+	for region, chunk := range bower.Atoms() {
+		if len(chunk) < libSize {
+			continue
+		}
+		uplimit = len(chunk) - libSize
+		for i := 0; i <= uplimit; i++ {
+			best, rmsd := lib.BestRMSD(chunk[i : i+libSize])
+			assigns = append(assigns, Assignment{
+				Region:     region,
+				Start:      i,
+				FragNumber: best,
+				RMSD:       rmsd,
+			})
+		}
+	}
+	return assigns
+}
+
+// BOW returns the bag-of-words vector for a library with `size` fragments
+// corresponding to these assignments.
+func (assigns Assignments) BOW(size int) BOW {
+	b := NewBow(size)
+	for _, a := range assigns {
+		b.Freqs[a.FragNumber] += 1
+	}
+	return b
+}
+
+// String returns one assignment per line.
+func (assigns Assignments) String() string {
+	lines := make([]string, len(assigns))
+	for i, a := range assigns {
+		lines[i] = a.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SequenceBOW computes a bag-of-words vector for the given value using
+// a sequence fragment library. Each window of residues with length equal to
+// the fragment size contributes a single vote for the fragment whose profile
+// scores it the highest. An empty library gives an empty BOW.
+func SequenceBOW(lib *fragbag.SequenceLibrary, bower SequenceBower) BOW {
 	var best, uplimit int
 
 	b := NewBow(lib.Size())
+	if lib.Size() == 0 {
+		return b
+	}
 	libSize := lib.FragmentSize
-	for _, chunk := range bower.Atoms() {
+	for _, chunk := range bower.Residues() {
 		if len(chunk) < libSize {
 			continue
 		}
 		uplimit = len(chunk) - libSize
 		for i := 0; i <= uplimit; i++ {
-			best = lib.Best(chunk[i : i+libSize])
+			best = lib.Best(seq.Sequence{
+				Name:     bower.Id(),
+				Residues: chunk[i : i+libSize],
+			})
 			b.Freqs[best] += 1
 		}
 	}
@@ -125,15 +247,22 @@ func (bow1 BOW) Add(bow2 BOW) BOW {
 	return sum
 }
 
+// All distance computations below accumulate in float64. Frequencies are
+// uint32, so differences can be negative and squares (or sums of squares)
+// can easily exceed the range of a uint32 for large entries. A float64
+// cannot overflow on these values, and it is exact for sums below 2^53.
+
 // Euclid returns the euclidean distance between bow1 and bow2.
 func (bow1 BOW) Euclid(bow2 BOW) float64 {
 	f1, f2 := bow1.Freqs, bow2.Freqs
-	squareSum := uint32(0)
+	squareSum := 0.0
 	libsize := bow1.Len()
+	var d float64
 	for i := 0; i < libsize; i++ {
-		squareSum += (f2[i] - f1[i]) * (f2[i] - f1[i])
+		d = float64(f2[i]) - float64(f1[i])
+		squareSum += d * d
 	}
-	return math.Sqrt(float64(squareSum))
+	return math.Sqrt(squareSum)
 }
 
 // Cosine returns the cosine distance between bow1 and bow2.
@@ -141,18 +270,18 @@ func (bow1 BOW) Cosine(bow2 BOW) float64 {
 	// This function is a hot-spot, so we manually inline the Dot
 	// and Magnitude computations.
 
-	var dot, mag1, mag2 uint32
+	var dot, mag1, mag2 float64
 	libs := len(bow1.Freqs)
 	freqs1, freqs2 := bow1.Freqs, bow2.Freqs
 
-	var f1, f2 uint32
+	var f1, f2 float64
 	for i := 0; i < libs; i++ {
-		f1, f2 = freqs1[i], freqs2[i]
+		f1, f2 = float64(freqs1[i]), float64(freqs2[i])
 		dot += f1 * f2
 		mag1 += f1 * f1
 		mag2 += f2 * f2
 	}
-	r := 1.0 - (float64(dot) / math.Sqrt(float64(mag1)*float64(mag2)))
+	r := 1.0 - (dot / math.Sqrt(mag1*mag2))
 	if math.IsNaN(r) {
 		return 1.0
 	}
@@ -161,24 +290,26 @@ func (bow1 BOW) Cosine(bow2 BOW) float64 {
 
 // Dot returns the dot product of bow1 and bow2.
 func (bow1 BOW) Dot(bow2 BOW) float64 {
-	dot := uint32(0)
+	dot := 0.0
 	libsize := bow1.Len()
 	f1, f2 := bow1.Freqs, bow2.Freqs
 	for i := 0; i < libsize; i++ {
-		dot += f1[i] * f2[i]
+		dot += float64(f1[i]) * float64(f2[i])
 	}
-	return float64(dot)
+	return dot
 }
 
 // Magnitude returns the vector length of the bow.
 func (bow BOW) Magnitude() float64 {
-	mag := uint32(0)
+	mag := 0.0
 	libsize := bow.Len()
 	fs := bow.Freqs
+	var f float64
 	for i := 0; i < libsize; i++ {
-		mag += fs[i] * fs[i]
+		f = float64(fs[i])
+		mag += f * f
 	}
-	return math.Sqrt(float64(mag))
+	return math.Sqrt(mag)
 }
 
 // String returns a string representation of the BOW vector. Only fragments
@@ -0,0 +1,180 @@
+package bow
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/BurntSushi/bcbgo/fragbag"
+	"github.com/TuftsBCB/seq"
+)
+
+// bowPair is a pair of BOWs with the same length that can be generated by
+// testing/quick. Frequencies are drawn from a few different ranges so that
+// both small BOWs and BOWs whose squared frequencies overflow a uint32 are
+// tested.
+type bowPair struct {
+	b1, b2 BOW
+}
+
+func (bowPair) Generate(rand *rand.Rand, size int) reflect.Value {
+	limits := []uint32{10, 1 << 10, 1 << 17, 1 << 24}
+	limit := limits[rand.Intn(len(limits))]
+	libs := 1 + rand.Intn(600)
+	b1, b2 := NewBow(libs), NewBow(libs)
+	for i := 0; i < libs; i++ {
+		// Make the vectors fairly sparse, like real BOWs.
+		if rand.Intn(3) == 0 {
+			b1.Freqs[i] = uint32(rand.Int63n(int64(limit)))
+		}
+		if rand.Intn(3) == 0 {
+			b2.Freqs[i] = uint32(rand.Int63n(int64(limit)))
+		}
+	}
+	return reflect.ValueOf(bowPair{b1, b2})
+}
+
+// The reference implementations below compute sums exactly with big integers
+// and only convert to float64 at the end.
+
+func refDot(b1, b2 BOW) *big.Int {
+	sum := new(big.Int)
+	for i := range b1.Freqs {
+		x := new(big.Int).SetUint64(uint64(b1.Freqs[i]))
+		y := new(big.Int).SetUint64(uint64(b2.Freqs[i]))
+		sum.Add(sum, x.Mul(x, y))
+	}
+	return sum
+}
+
+func refFloat(n *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f
+}
+
+func refEuclid(b1, b2 BOW) float64 {
+	sum := new(big.Int)
+	for i := range b1.Freqs {
+		d := new(big.Int).SetUint64(uint64(b1.Freqs[i]))
+		d.Sub(d, new(big.Int).SetUint64(uint64(b2.Freqs[i])))
+		sum.Add(sum, d.Mul(d, d))
+	}
+	return math.Sqrt(refFloat(sum))
+}
+
+func refCosine(b1, b2 BOW) float64 {
+	dot := refFloat(refDot(b1, b2))
+	mag1 := math.Sqrt(refFloat(refDot(b1, b1)))
+	mag2 := math.Sqrt(refFloat(refDot(b2, b2)))
+	r := 1.0 - dot/(mag1*mag2)
+	if math.IsNaN(r) {
+		return 1.0
+	}
+	return r
+}
+
+func closeEnough(expected, got float64) bool {
+	return math.Abs(expected-got) <= 1e-9*math.Max(1, math.Abs(expected))
+}
+
+func TestDistances(t *testing.T) {
+	check := func(name string, f func(bowPair) bool) {
+		if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	check("Euclid", func(p bowPair) bool {
+		return closeEnough(refEuclid(p.b1, p.b2), p.b1.Euclid(p.b2)) &&
+			closeEnough(refEuclid(p.b1, p.b2), p.b2.Euclid(p.b1))
+	})
+	check("Cosine", func(p bowPair) bool {
+		return closeEnough(refCosine(p.b1, p.b2), p.b1.Cosine(p.b2))
+	})
+	check("Dot", func(p bowPair) bool {
+		return closeEnough(refFloat(refDot(p.b1, p.b2)), p.b1.Dot(p.b2))
+	})
+	check("Magnitude", func(p bowPair) bool {
+		expected := math.Sqrt(refFloat(refDot(p.b1, p.b1)))
+		return closeEnough(expected, p.b1.Magnitude())
+	})
+}
+
+func TestEuclidNoWrap(t *testing.T) {
+	b1 := newBowMap(3, map[int]uint32{0: 5, 1: 100000})
+	b2 := newBowMap(3, map[int]uint32{0: 2, 2: 100000})
+	expected := math.Sqrt(9 + 2*100000*100000)
+	if got := b1.Euclid(b2); !closeEnough(expected, got) {
+		t.Fatalf("Expected euclidean distance %f but got %f.", expected, got)
+	}
+}
+
+func BenchmarkCosine(b *testing.B) {
+	var pair bowPair
+	rng := rand.New(rand.NewSource(1))
+	pair = pair.Generate(rng, 0).Interface().(bowPair)
+	pair.b2 = NewBow(pair.b1.Len())
+	for i := range pair.b2.Freqs {
+		pair.b2.Freqs[i] = uint32(rng.Intn(100))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pair.b1.Cosine(pair.b2)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	b1 := newBowMap(4, map[int]uint32{0: 2, 1: 2})
+	b2 := newBowMap(4, map[int]uint32{1: 2, 2: 2})
+	e1, e2 := Entry{Id: "1", BOW: b1}, Entry{Id: "2", BOW: b2}
+	w1 := Entry{Id: "1", Weighted: b1.Weighted()}
+	expected := map[Metric]float64{
+		Euclid:        math.Sqrt(8),
+		Cosine:        0.5,
+		Manhattan:     4,
+		Jaccard:       1 - 2.0/6.0,
+		BrayCurtis:    0.5,
+		JensenShannon: 0.5,
+	}
+	for _, m := range Metrics {
+		if got := m.Distance(e1, e2); !closeEnough(expected[m], got) {
+			t.Errorf("%s: expected %f but got %f.", m.Name(), expected[m], got)
+		}
+		if got := m.Distance(w1, e2); !closeEnough(expected[m], got) {
+			t.Errorf("%s (weighted): expected %f but got %f.",
+				m.Name(), expected[m], got)
+		}
+		if got := m.Distance(e1, e1); !closeEnough(0, got) {
+			t.Errorf("%s: expected 0 for identical BOWs but got %f.",
+				m.Name(), got)
+		}
+		if byName, err := MetricByName(m.Name()); err != nil || byName != m {
+			t.Errorf("Could not find metric '%s' by name.", m.Name())
+		}
+	}
+}
+
+// residues is a SequenceBower with a single region of residues.
+type residues string
+
+func (r residues) Id() string   { return string(r) }
+func (r residues) Data() string { return "" }
+
+func (r residues) Residues() [][]seq.Residue {
+	return [][]seq.Residue{seq.NewSequenceString("", string(r)).Residues}
+}
+
+func TestEmptyLibrary(t *testing.T) {
+	b := SequenceBOW(fragbag.NewSequenceLibrary("empty"), residues("ACDE"))
+	if b.Len() != 0 {
+		t.Fatalf("Expected an empty BOW but got %s.", b)
+	}
+	slib := fragbag.NewStructureLibrary("empty")
+	c := randomChain(rand.New(rand.NewSource(1)), "c")
+	if assigns := StructureAssign(slib, c); len(assigns) != 0 {
+		t.Fatalf("Expected no assignments but got %d.", len(assigns))
+	}
+}
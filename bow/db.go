@@ -2,10 +2,12 @@ package bow
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
-	"io"
-	"log"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"runtime"
@@ -18,29 +20,194 @@ import (
 // fragment library. In particular, the disk representation of the database is
 // a directory with a copy of the fragment library used to create the database
 // and a binary formatted file of all the frequency vectors computed.
+//
+// A BOW database may be built from either a structure fragment library or a
+// sequence fragment library. A BOW database built from a structure fragment
+// library may also use soft assignment, in which case every entry has a
+// weighted BOW instead of a BOW.
 type DB struct {
-	Lib  *fragbag.StructureLibrary
+	Lib  fragbag.Library
 	Path string
 	Name string
 	file *os.File
 
-	// Only set when opened in reading mode.
+	// The header of bow.db. It is nil for databases created before bow.db
+	// had a header.
+	header    *dbHeader
+	headerLen int
+
+	// The number of entries in bow.db, including deleted entries, and the
+	// positions of deleted entries.
+	records int
+	deleted map[int]bool
+
+	// The metadata of each entry, by Id. metaSeq is the number of values
+	// that had been added when SetMetadata was last called for each Id.
+	meta    map[string]Metadata
+	metaSeq map[string]int
+
+	// Used to find entries by Id when reading. byId maps Ids to indices in
+	// Entries, and idRecords are only used with OpenDBStream.
+	byId      map[string]int
+	idRecords []idRecord
+	idLock    sync.Mutex
+
+	// Soft is non-nil if and only if this database uses soft assignment.
+	Soft *SoftOptions
+
+	// When Ordered is true, entries are written in the order in which they
+	// were added (with Add or AddSequence), even though their BOWs are
+	// computed concurrently. This guarantees that building a database twice
+	// from the same values produces identical files. Otherwise, entries are
+	// written as soon as their BOWs are computed, which uses less memory.
+	//
+	// Ordered must be set before the first call to Add or AddSequence.
+	Ordered bool
+
+	// Fields are the metadata fields of the entries in the database. Fields
+	// must be set before the first call to Add, AddSequence or SetMetadata
+	// that uses them. When updating a database, new fields may be appended.
+	Fields []Field
+
+	// Duplicates is the policy for adding values with an Id that has
+	// already been added to the database: either DuplicateReject (the
+	// default) or DuplicateReplace. It must be set before the first call to
+	// Add or AddSequence.
+	Duplicates int
+
+	// The document frequency of each fragment in the database. Used for
+	// weighting BOWs in a search.
+	DocFreqs *DocFreqs
+
+	// The nearest neighbor index of the database, if it has one. It is nil
+	// after entries are added to or deleted from a database opened with
+	// OpenDBUpdate, until the database is closed.
+	Index *Index
+
+	// Only set when opened with OpenDB.
 	Entries []Entry
 
 	// for reading only
-	entryBuf []byte
+	stream       bool
+	weighted     map[int][]Entry
+	weightedLock sync.Mutex
+
+	// for updating only
+	updating   bool
+	positions  []int
+	offsets    []int64
+	updateLock sync.Mutex
+	indexed    bool
+	indexSeed  int64
 
 	// for writing only
 	writeBuf    *bytes.Buffer
-	writing     chan StructureBower
+	writing     chan bowJob
 	wg          *sync.WaitGroup
 	writingDone chan struct{}
-	entries     chan Entry
+	entries     chan bowResult
+	inflight    chan struct{}
+	seq         int
+	seqLock     sync.Mutex
+	submitted   map[string]bool
+	ids         map[string]idRecord
+	offset      int64
+	ctx         context.Context
+	cancel      context.CancelFunc
+	err         error
+	errLock     sync.Mutex
+
+	// When creating a database, it is written to a temporary directory
+	// (Path) and moved to dest when it is closed successfully.
+	dest string
+
+	// When updating a database, the size of bow.db and the number of
+	// records in it before any changes were made.
+	updateSize    int64
+	updateRecords int
+
+	// When staging, the files written with createFile are written to
+	// temporary files, and the files given to removeFile are kept, until
+	// commitFiles is called. This way, a database being updated is left
+	// unchanged if an error occurs before every file has been written.
+	staging bool
+	staged  []string
+	removed []string
+}
+
+// bowJob is a single value to have its BOW computed by a worker. Exactly one
+// of structure and sequence is non-nil. seq is the number of jobs added
+// before this one, and first is true if no other value with the same Id had
+// been added (since the Id was last deleted).
+type bowJob struct {
+	structure StructureBower
+	sequence  SequenceBower
+	meta      Metadata
+	seq       int
+	first     bool
+}
+
+// bowResult is the entry computed for the job with sequence number seq.
+type bowResult struct {
+	seq   int
+	first bool
+	entry Entry
+}
+
+func (job bowJob) id() string {
+	if job.structure != nil {
+		return job.structure.Id()
+	}
+	return job.sequence.Id()
+}
+
+// metadata returns the metadata of the job's value, if it implements
+// MetadataBower.
+func (job bowJob) metadata() Metadata {
+	var bower interface{} = job.sequence
+	if job.structure != nil {
+		bower = job.structure
+	}
+	if mbower, ok := bower.(MetadataBower); ok {
+		return mbower.Metadata()
+	}
+	return nil
 }
 
 // OpenDB opens a new BOW database for reading. In particular, all entries
-// in the database will be loaded into memory.
+// in the database will be loaded into memory. (Use OpenDBStream to read
+// entries on demand instead.)
 func OpenDB(dir string) (*DB, error) {
+	db, err := openDB(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Entries = make([]Entry, 0, 1000)
+	it := db.iterFile()
+	for it.Next() {
+		db.Entries = append(db.Entries, it.Entry())
+		db.positions = append(db.positions, it.Index())
+		db.offsets = append(db.offsets, it.offset)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	db.records, db.offset = it.Index(), it.next
+
+	db.DocFreqs, err = db.readDocFreqs()
+	if err != nil {
+		return nil, err
+	}
+	db.Index, err = db.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDB opens a BOW database for reading without reading any entries.
+func openDB(dir string) (*DB, error) {
 	var err error
 
 	db := &DB{
@@ -52,28 +219,27 @@ func OpenDB(dir string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer libf.Close()
 
-	db.Lib, err = fragbag.OpenStructureLibrary(libf)
+	db.Lib, err = fragbag.Open(libf)
 	if err != nil {
 		return nil, err
 	}
 
-	db.file, err = os.Open(db.filePath("bow.db"))
+	db.Soft, err = db.readSoftOptions()
 	if err != nil {
 		return nil, err
 	}
-
-	db.Entries = make([]Entry, 0, 1000)
-	for {
-		entry, err := db.read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		db.Entries = append(db.Entries, entry)
+	if err := db.readDBHeader(); err != nil {
+		return nil, err
+	}
+	db.deleted, err = db.readTombstones()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.readMetadata(); err != nil {
+		return nil, err
 	}
-
 	return db, nil
 }
 
@@ -82,87 +248,405 @@ func OpenDB(dir string) (*DB, error) {
 //
 // CreateDB starts GOMAXPROCS workers, where each worker computes a single
 // BOW at a time. You should call `Add` to add any value implementing the
-// Bower interface, and `Close` when finished adding.
+// StructureBower interface (or `AddSequence` for values implementing the
+// SequenceBower interface if 'lib' is a sequence fragment library), and
+// `Close` when finished adding.
+//
+// The database is written to a temporary directory next to 'dir', which is
+// renamed to 'dir' by `Close` only if every BOW was computed and written
+// successfully. Otherwise, the temporary directory is removed and `Close`
+// returns the first error encountered. (`Add` also returns this error as
+// soon as it occurs, so that callers can stop early.)
 //
-// One a BOW database is created, it cannot be modified.
-func CreateDB(lib *fragbag.StructureLibrary, dir string) (*DB, error) {
+// Once a BOW database is created, it can be modified by opening it with
+// OpenDBUpdate.
+func CreateDB(lib fragbag.Library, dir string) (*DB, error) {
+	return createDB(context.Background(), lib, dir, nil)
+}
+
+// CreateDBContext is just like CreateDB, except the database is built with
+// the given context. If the context is canceled before `Close` is called,
+// no BOWs are computed after the cancellation, no database is created and
+// `Add` and `Close` return the context's error.
+func CreateDBContext(
+	ctx context.Context,
+	lib fragbag.Library,
+	dir string,
+) (*DB, error) {
+	return createDB(ctx, lib, dir, nil)
+}
+
+// CreateSoftDB is just like CreateDB, except every entry in the database is
+// a weighted BOW computed with soft assignment using the options given.
+// Soft assignment requires a structure fragment library.
+func CreateSoftDB(
+	lib *fragbag.StructureLibrary,
+	dir string,
+	opts SoftOptions,
+) (*DB, error) {
+	return CreateSoftDBContext(context.Background(), lib, dir, opts)
+}
+
+// CreateSoftDBContext is just like CreateSoftDB, except the database is
+// built with the given context. (See CreateDBContext.)
+func CreateSoftDBContext(
+	ctx context.Context,
+	lib *fragbag.StructureLibrary,
+	dir string,
+	opts SoftOptions,
+) (*DB, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return createDB(ctx, lib, dir, &opts)
+}
+
+func createDB(
+	ctx context.Context,
+	lib fragbag.Library,
+	dir string,
+	soft *SoftOptions,
+) (*DB, error) {
 	var err error
 
 	_, err = os.Stat(dir)
 	if err == nil || !os.IsNotExist(err) {
 		return nil, fmt.Errorf("BOW database '%s' already exists.", dir)
 	}
-	if err = os.MkdirAll(dir, 0777); err != nil {
-		return nil, fmt.Errorf("Could not create '%s': %s", dir, err)
+	parent := path.Dir(dir)
+	if err = os.MkdirAll(parent, 0777); err != nil {
+		return nil, fmt.Errorf("Could not create '%s': %s", parent, err)
+	}
+	tmp, err := ioutil.TempDir(parent, "."+path.Base(dir)+".")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create temporary directory in "+
+			"'%s': %s", parent, err)
+	}
+	if err = os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("Could not create '%s': %s", tmp, err)
 	}
 
 	db := &DB{
-		Lib:  lib,
-		Path: dir,
-		Name: path.Base(dir),
+		Lib:      lib,
+		Path:     tmp,
+		Name:     path.Base(dir),
+		Soft:     soft,
+		DocFreqs: NewDocFreqs(lib.Size()),
 
-		writeBuf:    new(bytes.Buffer),
-		writing:     make(chan StructureBower),
-		entries:     make(chan Entry),
-		writingDone: make(chan struct{}),
-		wg:          new(sync.WaitGroup),
+		writeBuf: new(bytes.Buffer),
+		writing:  make(chan bowJob),
+		dest:     dir,
 	}
+	if err := db.createFiles(); err != nil {
+		if db.file != nil {
+			db.file.Close()
+		}
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	db.startWorkers(ctx)
+	return db, nil
+}
+
+// createFiles creates the files of a new database.
+func (db *DB) createFiles() error {
+	var err error
 
 	fp := db.filePath("bow.db")
 	db.file, err = os.Create(fp)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create '%s': %s", fp, err)
+		return fmt.Errorf("Could not create '%s': %s", fp, err)
+	}
+	db.header = db.newHeader()
+	header := db.header.bytes()
+	if _, err := db.file.Write(header); err != nil {
+		return fmt.Errorf("Could not write header of '%s': %s", fp, err)
 	}
+	db.offset = int64(len(header))
 
 	libfp := db.filePath("frag.lib")
 	libf, err := os.Create(libfp)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create '%s': %s", libfp, err)
+		return fmt.Errorf("Could not create '%s': %s", libfp, err)
 	}
 	if err := db.Lib.Save(libf); err != nil {
-		return nil, fmt.Errorf("Could not copy fragment library: %s", err)
+		libf.Close()
+		return fmt.Errorf("Could not copy fragment library: %s", err)
+	}
+	if err := closeFile(libf); err != nil {
+		return err
+	}
+	return db.writeSoftOptions()
+}
+
+// startWorkers spins up the goroutines that compute and write BOWs.
+//
+// Any error computing or writing a BOW is recorded (only the first is
+// kept) and cancels the context of the workers, so that no more work is
+// done.
+func (db *DB) startWorkers(ctx context.Context) {
+	db.ctx, db.cancel = context.WithCancel(ctx)
+	db.entries = make(chan bowResult)
+	db.writingDone = make(chan struct{})
+	db.wg = new(sync.WaitGroup)
+	if db.deleted == nil {
+		db.deleted = make(map[int]bool)
+	}
+	if db.ids == nil {
+		db.ids = make(map[string]idRecord)
+	}
+	db.submitted = make(map[string]bool, len(db.ids))
+	for id := range db.ids {
+		db.submitted[id] = true
 	}
 
+	// When entries are written in order, the number of jobs that have been
+	// added but not written is limited, which bounds the number of entries
+	// waiting in the reorder buffer.
+	workers := max(1, runtime.GOMAXPROCS(0))
+	db.inflight = make(chan struct{}, 4*workers)
+
 	// Spin up goroutines to compute BOWs.
-	for i := 0; i < max(1, runtime.GOMAXPROCS(0)); i++ {
+	db.wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go func() {
-			db.wg.Add(1)
-			for bower := range db.writing {
-				db.entries <- Entry{
-					Id:  bower.Id(),
-					BOW: StructureBOW(db.Lib, bower),
+			defer db.wg.Done()
+			for job := range db.writing {
+				entry, err := db.computeJob(job)
+				if err != nil {
+					db.fail(err)
+					continue
+				}
+				select {
+				case db.entries <- bowResult{job.seq, job.first, entry}:
+				case <-db.ctx.Done():
 				}
 			}
-			db.wg.Done()
 		}()
 	}
 
 	// Now spin up a goroutine that is responsible for writing entries.
+	// If entries are written in order, entries that arrive early wait in
+	// the reorder buffer until every entry before them has been written.
 	go func() {
-		for entry := range db.entries {
-			if err = db.write(entry); err != nil {
-				log.Printf("Could not write to bow.db: %s", err)
+		defer close(db.writingDone)
+		reorder := make(map[int]bowResult)
+		next := 0
+		for result := range db.entries {
+			if !db.Ordered {
+				db.writeEntry(result)
+				continue
+			}
+			reorder[result.seq] = result
+			for r, ok := reorder[next]; ok; r, ok = reorder[next] {
+				db.writeEntry(r)
+				delete(reorder, next)
+				next++
+				<-db.inflight
 			}
 		}
-		db.writingDone <- struct{}{}
 	}()
+}
 
-	return db, nil
+// writeEntry writes a single computed entry to the database, unless there
+// has already been an error.
+//
+// If an entry with the same Id has already been written (which is only
+// possible with DuplicateReplace), the entry added last is kept.
+func (db *DB) writeEntry(result bowResult) {
+	if db.Err() != nil {
+		return
+	}
+
+	db.updateLock.Lock()
+	defer db.updateLock.Unlock()
+
+	entry := result.entry
+	old, dup := db.ids[entry.Id]
+	if dup && old.seq > result.seq {
+		return
+	}
+	offset := db.offset
+	if err := db.write(entry); err != nil {
+		db.fail(fmt.Errorf("Could not write to '%s': %s",
+			db.filePath("bow.db"), err))
+		return
+	}
+	if dup {
+		if err := db.replaced(old); err != nil {
+			db.fail(err)
+			return
+		}
+	}
+	db.ids[entry.Id] = idRecord{entry.Id, offset, db.records - 1, result.seq}
+
+	// Metadata set with SetMetadata is kept if it was set after the value
+	// was added, or before the first value with its Id was added. Otherwise,
+	// it belongs to an entry that this one replaces.
+	if entry.Meta != nil {
+		db.setMetadata(entry.Id, entry.Meta)
+	} else if !result.first && db.metaSeq[entry.Id] <= result.seq {
+		db.setMetadata(entry.Id, nil)
+	}
+	entry.Meta = db.meta[entry.Id]
+	db.DocFreqs.Add(entry)
+	if db.updating {
+		db.Entries = append(db.Entries, entry)
+		db.positions = append(db.positions, db.records-1)
+		db.offsets = append(db.offsets, offset)
+		db.entriesChanged()
+	}
 }
 
-// Add will add any value implementing the Bower interface to the BOW
-// database. It is safe to call `Add` from multiple goroutines.
+// computeJob computes the entry for a job, and returns an error if
+// computing its BOW panics.
+func (db *DB) computeJob(job bowJob) (entry Entry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Could not compute BOW for '%s': %v", job.id(), r)
+		}
+	}()
+	return db.computeEntry(job), nil
+}
+
+// fail records an error encountered while writing the database, and stops
+// the workers.
+func (db *DB) fail(err error) {
+	db.errLock.Lock()
+	if db.err == nil {
+		db.err = err
+	}
+	db.errLock.Unlock()
+	db.cancel()
+}
+
+// Err returns the first error encountered while writing the database, or
+// nil if there have been no errors. If the database's context was canceled,
+// the context's error is returned.
+func (db *DB) Err() error {
+	db.errLock.Lock()
+	defer db.errLock.Unlock()
+
+	if db.err != nil {
+		return db.err
+	}
+	if db.ctx == nil {
+		return nil
+	}
+	return db.ctx.Err()
+}
+
+// computeEntry computes the BOW for a single job using the database's
+// fragment library.
+func (db *DB) computeEntry(job bowJob) Entry {
+	if db.Soft != nil {
+		return Entry{
+			Id:   job.structure.Id(),
+			Data: job.structure.Data(),
+			Meta: job.meta,
+			Weighted: structureSoftBOW(
+				db.Lib.(*fragbag.StructureLibrary), job.structure, *db.Soft),
+		}
+	}
+	if job.structure != nil {
+		return Entry{
+			Id:   job.structure.Id(),
+			Data: job.structure.Data(),
+			Meta: job.meta,
+			BOW:  ComputeBOW(db.Lib, job.structure),
+		}.compact()
+	}
+	return Entry{
+		Id:   job.sequence.Id(),
+		Data: job.sequence.Data(),
+		Meta: job.meta,
+		BOW:  ComputeBOW(db.Lib, job.sequence),
+	}.compact()
+}
+
+// Add will add any value implementing the StructureBower interface to the
+// BOW database. It is safe to call `Add` from multiple goroutines.
 //
 // Note that `CreateDB` will already compute BOWs concurrently, which will
-// take advantage of parallelism when multiple CPUs are present.
+// take advantage of parallelism when multiple CPUs are present. Therefore,
+// an error returned by Add may have been caused by a value given in a
+// previous call. Once Add returns an error, every subsequent call will
+// return the same error, and the database will not be written.
+//
+// The exceptions are values rejected because of their Id (see Duplicates)
+// or because their metadata doesn't fit the fields of the database, which
+// are not added but do not affect the rest of the database. The metadata of
+// values implementing MetadataBower is stored with their entries.
 //
 // Add will panic if it is called on a BOW database that been opened for
-// reading.
-func (db *DB) Add(bower StructureBower) {
+// reading, or if the database uses a sequence fragment library.
+func (db *DB) Add(bower StructureBower) error {
 	if db.writing == nil {
 		panic("Cannot add to a BOW database opened in read mode.")
 	}
-	db.writing <- bower
+	if _, ok := db.Lib.(*fragbag.StructureLibrary); !ok {
+		panic("Cannot add a StructureBower to a BOW database with a " +
+			"sequence fragment library.")
+	}
+	return db.add(bowJob{structure: bower})
+}
+
+// AddSequence is just like Add, except it adds values implementing the
+// SequenceBower interface to a BOW database with a sequence fragment library.
+//
+// AddSequence will panic if it is called on a BOW database that been opened
+// for reading, or if the database uses a structure fragment library.
+func (db *DB) AddSequence(bower SequenceBower) error {
+	if db.writing == nil {
+		panic("Cannot add to a BOW database opened in read mode.")
+	}
+	if _, ok := db.Lib.(*fragbag.SequenceLibrary); !ok {
+		panic("Cannot add a SequenceBower to a BOW database with a " +
+			"structure fragment library.")
+	}
+	return db.add(bowJob{sequence: bower})
+}
+
+// add hands a job to the workers, unless there has been an error.
+func (db *DB) add(job bowJob) error {
+	if err := db.Err(); err != nil {
+		return err
+	}
+	meta, err := db.checkMetadata(job.id(), job.metadata())
+	if err != nil {
+		return err
+	}
+	job.meta = meta
+	if db.Ordered {
+		select {
+		case db.inflight <- struct{}{}:
+		case <-db.ctx.Done():
+			return db.Err()
+		}
+	}
+
+	// The sequence number must be assigned while sending the job, so that
+	// jobs are received by the workers in sequence order. Otherwise, a job
+	// could wait on a full reorder buffer that's waiting on the job.
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+	job.first = !db.submitted[job.id()]
+	if err := db.checkDuplicate(job.id()); err != nil {
+		if db.Ordered {
+			<-db.inflight
+		}
+		return err
+	}
+	job.seq = db.seq
+	select {
+	case db.writing <- job:
+		db.seq++
+		return nil
+	case <-db.ctx.Done():
+		return db.Err()
+	}
 }
 
 // filePath concatenates the BOW database path with a file name.
@@ -170,15 +654,193 @@ func (db *DB) filePath(name string) string {
 	return path.Join(db.Path, name)
 }
 
+// createFile creates the file with the given name in the database directory.
+// When staging, a temporary file is created instead, which replaces the file
+// when commitFiles is called.
+func (db *DB) createFile(name string) (*os.File, error) {
+	fp := db.filePath(name)
+	if db.staging {
+		fp += ".tmp"
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create '%s': %s", fp, err)
+	}
+	if db.staging {
+		db.staged = append(db.staged, name)
+	}
+	return f, nil
+}
+
+// closeFile closes a file written to the database directory. Since writes
+// may be buffered until the file is closed, an error closing it is an error
+// writing it.
+func closeFile(f *os.File) error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Could not write '%s': %s", f.Name(), err)
+	}
+	return nil
+}
+
+// removeFile removes the file with the given name from the database
+// directory, if it exists. When staging, it is removed when commitFiles is
+// called.
+func (db *DB) removeFile(name string) error {
+	if db.staging {
+		db.removed = append(db.removed, name)
+		return nil
+	}
+	fp := db.filePath(name)
+	if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove '%s': %s", fp, err)
+	}
+	return nil
+}
+
+// commitFiles removes the files given to removeFile and moves the files
+// written with createFile into place. Files are removed first, since a
+// stale file (e.g., tombstones) can be worse than a missing one.
+func (db *DB) commitFiles() error {
+	for _, name := range db.removed {
+		fp := db.filePath(name)
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove '%s': %s", fp, err)
+		}
+	}
+	for i, name := range db.staged {
+		fp := db.filePath(name)
+		if err := os.Rename(fp+".tmp", fp); err != nil {
+			db.staged = db.staged[i:]
+			return fmt.Errorf("Could not replace '%s': %s", fp, err)
+		}
+	}
+	db.staged, db.removed = nil, nil
+	return nil
+}
+
+// discardFiles removes the temporary files written with createFile that
+// haven't been committed.
+func (db *DB) discardFiles() error {
+	var first error
+	for _, name := range db.staged {
+		fp := db.filePath(name) + ".tmp"
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) &&
+			first == nil {
+			first = fmt.Errorf("Could not remove '%s': %s", fp, err)
+		}
+	}
+	db.staged, db.removed = nil, nil
+	return first
+}
+
 // Close should be called when done reading/writing a BOW db.
+//
+// When writing, Close waits for every BOW to be computed and written, and
+// returns the first error encountered. If there was an error, a database
+// being created is removed and the changes to a database being updated are
+// discarded.
 func (db *DB) Close() error {
-	if db.writing != nil {
-		close(db.writing)
-		db.wg.Wait()
-		close(db.entries)
-		<-db.writingDone
+	if db.writing == nil {
+		if db.file == nil {
+			return nil
+		}
+		return db.file.Close()
 	}
-	return db.file.Close()
+
+	close(db.writing)
+	db.wg.Wait()
+	close(db.entries)
+	<-db.writingDone
+
+	err := db.Err()
+	if err == nil {
+		err = db.finish()
+	}
+	db.cancel()
+	if err == nil {
+		if err = db.file.Close(); err != nil {
+			err = fmt.Errorf("Could not write '%s': %s",
+				db.filePath("bow.db"), err)
+		}
+	}
+	if err != nil {
+		if aerr := db.abort(); aerr != nil {
+			return fmt.Errorf("%s (The changes could not be discarded: %s)",
+				err, aerr)
+		}
+		return err
+	}
+	if db.dest != "" {
+		if err := os.Rename(db.Path, db.dest); err != nil {
+			os.RemoveAll(db.Path)
+			return fmt.Errorf("Could not move '%s' to '%s': %s",
+				db.Path, db.dest, err)
+		}
+		db.Path, db.dest = db.dest, ""
+	}
+	return nil
+}
+
+// finish writes everything other than the entries of a database being
+// written.
+func (db *DB) finish() error {
+	if db.header != nil {
+		if err := db.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if err := db.writeDocFreqs(); err != nil {
+		return err
+	}
+	if err := db.writeIds(); err != nil {
+		return err
+	}
+	if err := db.writeMetadata(); err != nil {
+		return err
+	}
+	if err := db.writeTombstones(); err != nil {
+		return err
+	}
+	if db.updating {
+		if err := db.closeUpdate(); err != nil {
+			return err
+		}
+	}
+	if db.staging {
+		return db.commitFiles()
+	}
+	return nil
+}
+
+// abort discards a database being written after an error. A database being
+// created is removed. For a database being updated, bow.db is restored to
+// its original size and header, and the files that weren't committed are
+// removed. The first error encountered is returned.
+func (db *DB) abort() error {
+	var first error
+	check := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if db.updating {
+		if err := db.file.Truncate(db.updateSize); err != nil {
+			check(fmt.Errorf("Could not truncate '%s': %s",
+				db.filePath("bow.db"), err))
+		}
+		if db.header != nil {
+			db.records = db.updateRecords
+			check(db.writeHeader())
+		}
+		check(db.discardFiles())
+	}
+	db.file.Close()
+	if db.dest != "" {
+		if err := os.RemoveAll(db.Path); err != nil {
+			check(fmt.Errorf("Could not remove '%s': %s", db.Path, err))
+		}
+	}
+	return first
 }
 
 func (db *DB) String() string {
@@ -188,9 +850,143 @@ func (db *DB) String() string {
 // Entry corresponds to a single row in the BOW database. It is uniquely
 // identified by Id, which is typically constructed as the concatenation
 // of the 4 letter PDB Id Code with the single letter chain identifier.
+//
+// Entries in a database with soft assignment have a weighted BOW instead of
+// a BOW. Entries with few non-zero frequencies have a sparse BOW instead of
+// a BOW (which is empty), since the sparse BOW uses less memory. Use
+// DenseBOW to get the BOW of an entry regardless of its representation.
+//
+// Data is the data given by the value the entry was computed from. It is
+// always empty for entries in databases created before it was stored. Meta
+// is the metadata of the entry, if it has any.
 type Entry struct {
-	Id  string
-	BOW BOW
+	Id       string
+	Data     string
+	Meta     Metadata
+	BOW      BOW
+	Weighted WeightedBOW
+	Sparse   SparseBOW
+}
+
+// IsWeighted returns true if this entry has a weighted BOW.
+func (e Entry) IsWeighted() bool {
+	return e.Weighted.Weights != nil
+}
+
+// IsSparse returns true if this entry has a sparse BOW.
+func (e Entry) IsSparse() bool {
+	return e.Sparse.Size > 0
+}
+
+// DenseBOW returns the BOW of this entry, converting its sparse BOW if
+// necessary. It should not be used for entries with a weighted BOW.
+func (e Entry) DenseBOW() BOW {
+	if e.IsSparse() {
+		return e.Sparse.BOW()
+	}
+	return e.BOW
+}
+
+// Cosine returns the cosine distance between the BOWs of two entries.
+// If either entry is weighted, then the weighted BOWs are compared.
+func (e1 Entry) Cosine(e2 Entry) float64 {
+	switch {
+	case e1.IsWeighted() || e2.IsWeighted():
+		return e1.weighted().Cosine(e2.weighted())
+	case e1.IsSparse() && e2.IsSparse():
+		return e1.Sparse.Cosine(e2.Sparse)
+	case e1.IsSparse():
+		return e1.Sparse.CosineBOW(e2.BOW)
+	case e2.IsSparse():
+		return e2.Sparse.CosineBOW(e1.BOW)
+	}
+	return e1.BOW.Cosine(e2.BOW)
+}
+
+// Euclid returns the euclidean distance between the BOWs of two entries.
+// If either entry is weighted, then the weighted BOWs are compared.
+func (e1 Entry) Euclid(e2 Entry) float64 {
+	switch {
+	case e1.IsWeighted() || e2.IsWeighted():
+		return e1.weighted().Euclid(e2.weighted())
+	case e1.IsSparse() && e2.IsSparse():
+		return e1.Sparse.Euclid(e2.Sparse)
+	case e1.IsSparse():
+		return e1.Sparse.EuclidBOW(e2.BOW)
+	case e2.IsSparse():
+		return e2.Sparse.EuclidBOW(e1.BOW)
+	}
+	return e1.BOW.Euclid(e2.BOW)
+}
+
+// compact returns this entry with a sparse BOW instead of a BOW if the
+// sparse BOW is smaller. (A sparse BOW uses 8 bytes per non-zero frequency
+// while a BOW uses 4 bytes per fragment.)
+func (e Entry) compact() Entry {
+	if e.IsWeighted() || e.IsSparse() {
+		return e
+	}
+	nnz := 0
+	for _, f := range e.BOW.Freqs {
+		if f > 0 {
+			nnz++
+		}
+	}
+	if 2*nnz >= e.BOW.Len() {
+		return e
+	}
+	return Entry{Id: e.Id, Data: e.Data, Meta: e.Meta, Sparse: e.BOW.Sparse()}
+}
+
+// weighted returns the weighted BOW of this entry, converting its BOW if
+// necessary.
+func (e Entry) weighted() WeightedBOW {
+	if e.IsWeighted() {
+		return e.Weighted
+	}
+	return e.DenseBOW().Weighted()
+}
+
+// readSoftOptions reads the soft assignment options of this database, if
+// they exist. Databases without soft assignment have no options file.
+func (db *DB) readSoftOptions() (*SoftOptions, error) {
+	f, err := os.Open(db.filePath("soft.opts"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var opts SoftOptions
+	if err := gob.NewDecoder(f).Decode(&opts); err != nil {
+		return nil, fmt.Errorf("Could not read soft assignment options: %s",
+			err)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// writeSoftOptions writes the soft assignment options of this database, if
+// it has any.
+func (db *DB) writeSoftOptions() error {
+	if db.Soft == nil {
+		return nil
+	}
+
+	fp := db.filePath("soft.opts")
+	f, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("Could not create '%s': %s", fp, err)
+	}
+	if err := gob.NewEncoder(f).Encode(*db.Soft); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write soft assignment options: %s", err)
+	}
+	return closeFile(f)
 }
 
 func max(a, b int) int {
@@ -200,56 +996,108 @@ func max(a, b int) int {
 	return b
 }
 
-// read will read a single entry from the BOW database.
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// decode decodes a single entry read from the BOW database.
 //
 // It would be much nicer to use the binary package here (like we do for
-// reading), but we need to be as fast here as possible. (It looks like
+// writing), but we need to be as fast here as possible. (It looks like
 // there is a fair bit of allocation going on in the binary package.)
 // Benchmarks are gone in the wind...
-func (db *DB) read() (Entry, error) {
+func (db *DB) decode(entry []byte) (Entry, error) {
 	libs := db.Lib.Size()
+	mismatch := func() (Entry, error) {
+		return Entry{}, fmt.Errorf("Entry with length %d does not fit a "+
+			"fragment library of size %d. Was the BOW database created "+
+			"with a different fragment library?", len(entry), libs)
+	}
 
-	// Find the number of bytes used by the next entry.
-	entryLenBs := make([]byte, 4)
-	if n, err := db.file.Read(entryLenBs); err != nil {
-		// Test the first read to see if we're at the end.
-		// This is the only place where it's OK to see an EOF.
-		if err == io.EOF {
-			return Entry{}, err
-		}
-		return Entry{}, fmt.Errorf("Error reading entry length: %s", err)
-	} else if n != len(entryLenBs) {
-		return Entry{},
-			fmt.Errorf("Expected entry length with length %d, but got %d",
-				len(entryLenBs), n)
-	}
-	entryLen := readUint32(entryLenBs)
-
-	// Read in the full entry.
-	if db.entryBuf == nil || int(entryLen) > cap(db.entryBuf) {
-		db.entryBuf = make([]byte, entryLen)
-	}
-	entry := db.entryBuf[0:entryLen]
-	if n, err := db.file.Read(entry); err != nil {
-		return Entry{},
-			fmt.Errorf("Error reading entry: %s", err)
-	} else if n != len(entry) {
-		return Entry{},
-			fmt.Errorf("Expected entry with length %d, but got %d",
-				len(entry), n)
-	}
-
-	// Now gobble up a null terminated id string and the BOW vector.
-	id := string(entry[0 : len(entry)-(1+libs*2)])
-	vector := entry[len(id)+1:]
-	freqs := make([]uint32, libs)
-	for i := 0; i < libs; i++ {
-		freqs[i] = readUint16As32(vector[i*2:])
+	// Now gobble up a null terminated id string, the entry's data and the
+	// BOW vector. Only databases with format version 4 or later have data,
+	// which is its length (as a uvarint) followed by the data itself.
+	// Weighted BOWs use 4 bytes per fragment. BOWs use 2 bytes per fragment,
+	// unless the database has variable width entries, in which case the
+	// number of bytes per fragment is the first byte of the vector. A width
+	// of 0 means that the BOW uses the sparse encoding.
+	var id, data string
+	var vector []byte
+	width := 2
+	if db.encoding() == encodingFloat32 {
+		width = 4
+	}
+	if db.hasData() || db.encoding() == encodingVarWidth {
+		idLen := bytes.IndexByte(entry, 0)
+		if idLen < 0 {
+			return mismatch()
+		}
+		id, vector = string(entry[0:idLen]), entry[idLen+1:]
+	} else {
+		idLen := len(entry) - (1 + libs*width)
+		if idLen < 0 || entry[idLen] != 0 {
+			return mismatch()
+		}
+		id, vector = string(entry[0:idLen]), entry[idLen+1:]
+	}
+	if db.hasData() {
+		dataLen, n := binary.Uvarint(vector)
+		if n <= 0 || dataLen > uint64(len(vector)-n) {
+			return mismatch()
+		}
+		data = string(vector[n : n+int(dataLen)])
+		vector = vector[n+int(dataLen):]
+	}
+	if db.encoding() == encodingVarWidth {
+		if len(vector) == 0 {
+			return mismatch()
+		}
+		width, vector = int(vector[0]), vector[1:]
+		if width == 0 {
+			sparse, err := decodeSparse(vector, libs)
+			if err != nil {
+				return Entry{}, err
+			}
+			return Entry{
+				Id:     id,
+				Data:   data,
+				Sparse: sparse,
+			}, nil
+		}
+	}
+	if width != 2 && width != 4 || len(vector) != libs*width {
+		return mismatch()
 	}
 
+	if db.encoding() == encodingFloat32 {
+		weights := make([]float64, libs)
+		for i := 0; i < libs; i++ {
+			weights[i] = float64(math.Float32frombits(readUint32(vector[i*4:])))
+		}
+		return Entry{
+			Id:       id,
+			Data:     data,
+			Weighted: WeightedBOW{weights},
+		}, nil
+	}
+
+	freqs := make([]uint32, libs)
+	if width == 4 {
+		for i := 0; i < libs; i++ {
+			freqs[i] = readUint32(vector[i*4:])
+		}
+	} else {
+		for i := 0; i < libs; i++ {
+			freqs[i] = readUint16As32(vector[i*2:])
+		}
+	}
 	return Entry{
-		Id:  id,
-		BOW: BOW{freqs},
+		Id:   id,
+		Data: data,
+		BOW:  BOW{freqs},
 	}, nil
 }
 
@@ -278,8 +1126,59 @@ func (db *DB) write(entry Entry) error {
 		return fmt.Errorf("Something bad has happened when trying to write "+
 			"id: %s.", err)
 	}
-	for i := 0; i < libSize; i++ {
-		f := int16(entry.BOW.Freqs[i])
+	if db.hasData() {
+		var dataLen [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(dataLen[:], uint64(len(entry.Data)))
+		buf.Write(dataLen[:n])
+		buf.WriteString(entry.Data)
+	}
+	var freqs []uint32
+	if db.encoding() != encodingFloat32 {
+		freqs = entry.DenseBOW().Freqs
+	}
+	width := 2
+	switch db.encoding() {
+	case encodingFloat32:
+		width = 4
+	case encodingInt16:
+		for i, f := range freqs {
+			if f > math.MaxUint16 {
+				return fmt.Errorf("The frequency %d of fragment %d in '%s' "+
+					"does not fit in the 16 bit frequencies of the BOW "+
+					"database '%s'.", f, i, entry.Id, db)
+			}
+		}
+	case encodingVarWidth:
+		for _, f := range freqs {
+			if f > math.MaxUint16 {
+				width = 4
+				break
+			}
+		}
+
+		// Use the sparse encoding instead if it's smaller.
+		sparse := entry.Sparse
+		if !entry.IsSparse() {
+			sparse = entry.BOW.Sparse()
+		}
+		if enc := sparse.encode(); len(enc) < libSize*width {
+			width = 0
+			buf.WriteByte(0)
+			buf.Write(enc)
+		} else {
+			buf.WriteByte(byte(width))
+		}
+	}
+	for i := 0; i < libSize && width > 0; i++ {
+		var f interface{}
+		switch {
+		case db.encoding() == encodingFloat32:
+			f = float32(entry.Weighted.Weights[i])
+		case width == 4:
+			f = freqs[i]
+		default:
+			f = uint16(freqs[i])
+		}
 		if err := binary.Write(buf, endian, f); err != nil {
 			return fmt.Errorf("Something bad has happened when trying to "+
 				"write BOW: %s.", err)
@@ -288,7 +1187,11 @@ func (db *DB) write(entry Entry) error {
 
 	// Write the number of bytes in this entry.
 	// (To make reading easier.)
+	// Databases with a header also have a checksum after each entry.
 	entryLen := uint32(buf.Len())
+	if db.header != nil {
+		binary.Write(buf, endian, checksum(buf.Bytes()))
+	}
 	if err := binary.Write(db.file, endian, entryLen); err != nil {
 		return fmt.Errorf("Something bad has happened when trying to write "+
 			"entry size to the bow.db: %s.", err)
@@ -299,6 +1202,8 @@ func (db *DB) write(entry Entry) error {
 		return fmt.Errorf("Something bad has happened when trying to write "+
 			"to the bow.db: %s.", err)
 	}
+	db.records++
+	db.offset += int64(4 + buf.Len())
 
 	return nil
 }
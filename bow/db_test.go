@@ -0,0 +1,591 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/TuftsBCB/structure"
+)
+
+// chain is a StructureBower with a single region of atoms.
+type chain struct {
+	id, data string
+	atoms    []structure.Coords
+}
+
+func (c chain) Id() string   { return c.id }
+func (c chain) Data() string { return c.data }
+
+func (c chain) Atoms() [][]structure.Coords {
+	return [][]structure.Coords{c.atoms}
+}
+
+// randomChain returns a chain whose atoms are a random walk with steps of
+// roughly the distance between consecutive alpha-carbons.
+func randomChain(rng *rand.Rand, id string) chain {
+	atoms := make([]structure.Coords, 15+rng.Intn(30))
+	for i := 1; i < len(atoms); i++ {
+		atoms[i] = structure.Coords{
+			X: atoms[i-1].X + 3.8*(rng.Float64()-0.5),
+			Y: atoms[i-1].Y + 3.8*(rng.Float64()-0.5),
+			Z: atoms[i-1].Z + 3.8*(rng.Float64()-0.5),
+		}
+	}
+	return chain{id: id, data: "data for " + id, atoms: atoms}
+}
+
+// tempDBPath returns a path for a new database in a new temporary
+// directory. The caller should remove the parent of the path when done.
+func tempDBPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bowdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, "test")
+}
+
+// createTestDB creates a database on disk with the chains given.
+func createTestDB(t *testing.T, chains []chain) string {
+	dir := tempDBPath(t)
+	db, err := CreateDB(library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chains {
+		db.Add(c)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// checkEntries checks that the database has exactly the chains given, in
+// any order, and that its document frequencies are consistent with its
+// entries.
+func checkEntries(t *testing.T, db *DB, chains []chain) {
+	if len(db.Entries) != len(chains) {
+		t.Fatalf("Expected %d entries but got %d.",
+			len(chains), len(db.Entries))
+	}
+	byId := make(map[string]Entry)
+	for _, entry := range db.Entries {
+		byId[entry.Id] = entry
+	}
+	for _, c := range chains {
+		entry, ok := byId[c.id]
+		if !ok {
+			t.Fatalf("Could not find entry '%s'.", c.id)
+		}
+		expected := ComputeBOW(library, c)
+		if !entry.DenseBOW().Equal(expected) {
+			t.Fatalf("Entry '%s' has BOW %s but expected %s.",
+				c.id, entry.DenseBOW(), expected)
+		}
+		if entry.Data != c.data {
+			t.Fatalf("Entry '%s' has data '%s' but expected '%s'.",
+				c.id, entry.Data, c.data)
+		}
+	}
+
+	df := NewDocFreqs(library.Size())
+	for _, entry := range db.Entries {
+		df.Add(entry)
+	}
+	if fmt.Sprint(*df) != fmt.Sprint(*db.DocFreqs) {
+		t.Fatalf("Document frequencies are %v but expected %v.",
+			*db.DocFreqs, *df)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	rng := rand.New(rand.NewSource(10))
+	chains := make([]chain, 20)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BuildIndex(1); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Delete("c03"); n != 1 {
+		t.Fatalf("Deleted %d entries but expected 1.", n)
+	}
+	chains[5] = randomChain(rng, "c05")
+	db.Replace(chains[5])
+	added := randomChain(rng, "c20")
+	db.Add(added)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chains = append(append(chains[:3], chains[4:]...), added)
+
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+	if db.Index == nil || db.Index.Entries != len(chains) {
+		t.Fatalf("Index was not rebuilt: %v", db.Index)
+	}
+
+	before, err := os.Stat(db.filePath("bow.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompactDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(db.filePath("bow.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("Compaction did not shrink bow.db: %d bytes before and "+
+			"%d bytes after.", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(db.filePath("bow.del")); !os.IsNotExist(err) {
+		t.Fatalf("Tombstones were not removed by compaction.")
+	}
+
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+	if db.records != len(chains) {
+		t.Fatalf("bow.db has %d records after compaction but expected %d.",
+			db.records, len(chains))
+	}
+}
+
+func TestUpdateSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+	chains := make([]chain, 20)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BuildIndex(1); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := db.Query(chains[3])
+	options := func(weighting int) SearchOptions {
+		opts := SearchDefault
+		opts.Limit = -1
+		opts.Weighting = weighting
+		return opts
+	}
+	search := func(weighting int) []SearchResult {
+		return mustSearch(t, db, options(weighting), query)
+	}
+
+	// Search once with each weighting so that the index is used and the
+	// weighted entries are cached before the entries change.
+	for _, weighting := range []int{WeightNone, WeightTFIDF} {
+		if n := len(search(weighting)); n != len(chains) {
+			t.Fatalf("Expected %d results but got %d.", len(chains), n)
+		}
+	}
+	db.Delete("c03")
+	for _, weighting := range []int{WeightNone, WeightTFIDF} {
+		results := search(weighting)
+		if len(results) != len(chains)-1 {
+			t.Fatalf("Expected %d results after deleting an entry but "+
+				"got %d.", len(chains)-1, len(results))
+		}
+		for _, r := range results {
+			if r.Id == "c03" {
+				t.Fatalf("Deleted entry 'c03' was found by a search.")
+			}
+		}
+	}
+
+	// Searching while entries are added must be safe.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_, err := db.SearchEntry(options(WeightBM25), query)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		db.Add(randomChain(rng, fmt.Sprintf("new%02d", i)))
+	}
+	<-done
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateFailure(t *testing.T) {
+	rng := rand.New(rand.NewSource(13))
+	chains := make([]chain, 10)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BuildIndex(1); err != nil {
+		t.Fatal(err)
+	}
+	readFiles := func() map[string]string {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := make(map[string]string)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			bs, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[f.Name()] = string(bs)
+		}
+		return contents
+	}
+	before := readFiles()
+
+	// Make rebuilding the index fail, which happens after every other file
+	// has been written.
+	if err := os.Mkdir(path.Join(dir, "bow.idx.tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("c03")
+	db.Add(randomChain(rng, "c10"))
+	if err := db.Close(); err == nil {
+		t.Fatalf("Closing the database did not fail.")
+	}
+	if err := os.Remove(path.Join(dir, "bow.idx.tmp")); err != nil {
+		t.Fatal(err)
+	}
+
+	after := readFiles()
+	if len(after) != len(before) {
+		t.Fatalf("The files of the database changed from %d to %d.",
+			len(before), len(after))
+	}
+	for name, contents := range before {
+		if after[name] != contents {
+			t.Fatalf("'%s' was changed by a failed update.", name)
+		}
+	}
+}
+
+func TestUpdateInterrupted(t *testing.T) {
+	rng := rand.New(rand.NewSource(14))
+	chains := make([]chain, 10)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := make(map[string][]byte)
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original[f.Name()] = bs
+	}
+
+	// Simulate an update that was interrupted after appending entries to
+	// bow.db, but before anything else was written.
+	db, err := OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Add(randomChain(rng, "lost"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := ioutil.ReadFile(path.Join(dir, "bow.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original["bow.db"] = append(original["bow.db"],
+		updated[len(original["bow.db"]):]...)
+	for name, bs := range original {
+		err := ioutil.WriteFile(path.Join(dir, name), bs, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The appended entry is ignored, and overwritten by the next update.
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	added := randomChain(rng, "added")
+	db.Add(added)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chains = append(chains, added)
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+
+	if err := CompactDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	chains := make([]chain, 10)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	db, err := OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("c02")
+	db.Delete("c06")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chains = append(append(chains[:2], chains[3:6]...), chains[7:]...)
+	old := make(map[string][]byte)
+	for _, name := range []string{"bow.del", "bow.ids"} {
+		if old[name], err = ioutil.ReadFile(path.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a compaction that was interrupted after replacing bow.db,
+	// but before replacing the tombstones and Id index.
+	if err := CompactDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, bs := range old {
+		err := ioutil.WriteFile(path.Join(dir, name), bs, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stale tombstones and Id index are ignored.
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+	stream, err := OpenDBStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, stream, chains)
+	if stream.Has("c02") || stream.Has("c06") {
+		t.Fatalf("A deleted entry is in the database.")
+	}
+
+	// And the next update replaces them.
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("c04")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chains = append(chains[:3], chains[4:]...)
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+	if stream, err = OpenDBStream(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, stream, chains)
+}
+
+// panicChain is a StructureBower whose atoms can't be read.
+type panicChain struct{ chain }
+
+func (c panicChain) Atoms() [][]structure.Coords {
+	panic("no atoms")
+}
+
+// checkNoDB checks that a database creation that failed left nothing behind.
+func checkNoDB(t *testing.T, dir string) {
+	files, err := ioutil.ReadDir(path.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Fatalf("Failed database creation left '%s' behind.",
+			files[0].Name())
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := CreateDB(library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := panicChain{randomChain(rng, "bad")}
+	for i := 0; i < 100; i++ {
+		var err error
+		if i == 10 {
+			err = db.Add(bad)
+		} else {
+			err = db.Add(randomChain(rng, fmt.Sprintf("c%02d", i)))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err := db.Close(); err == nil {
+		t.Fatalf("Expected an error computing the BOW of '%s'.", bad.id)
+	}
+	checkNoDB(t, dir)
+}
+
+func TestCreateCancel(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := CreateDBContext(ctx, library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err := db.Add(randomChain(rng, fmt.Sprintf("c%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if err := db.Add(randomChain(rng, "late")); err != context.Canceled {
+		t.Fatalf("Expected a cancellation error but got %v.", err)
+	}
+	if err := db.Close(); err != context.Canceled {
+		t.Fatalf("Expected a cancellation error but got %v.", err)
+	}
+	checkNoDB(t, dir)
+}
+
+func TestOrdered(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	rng := rand.New(rand.NewSource(13))
+	chains := make([]metaChain, 100)
+	for i := range chains {
+		chains[i] = metaChain{
+			randomChain(rng, fmt.Sprintf("c%02d", i)), randomMetadata(rng),
+		}
+	}
+
+	build := func() string {
+		dir := tempDBPath(t)
+		db, err := CreateDB(library, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Ordered = true
+		db.Fields = testFields
+		for _, c := range chains {
+			if err := db.Add(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	dir1, dir2 := build(), build()
+	defer os.RemoveAll(path.Dir(dir1))
+	defer os.RemoveAll(path.Dir(dir2))
+
+	files := []string{"bow.db", "bow.ids", "bow.meta", "frag.df", "frag.lib"}
+	for _, name := range files {
+		f1, err := ioutil.ReadFile(path.Join(dir1, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := ioutil.ReadFile(path.Join(dir2, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f1, f2) {
+			t.Fatalf("'%s' differs between two builds.", name)
+		}
+	}
+
+	db, err := OpenDB(dir1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range db.Entries {
+		if entry.Id != chains[i].id {
+			t.Fatalf("Entry %d is '%s' but expected '%s'.",
+				i, entry.Id, chains[i].id)
+		}
+	}
+}
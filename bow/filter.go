@@ -0,0 +1,70 @@
+package bow
+
+import "fmt"
+
+// A Filter is a predicate applied to the entries of a database during a
+// search (see SearchOptions.Filters). Only entries for which it returns true
+// can be results. query is the entry being searched for.
+type Filter func(query, entry Entry) bool
+
+// FilterRange keeps the entries whose value of the int or float field given
+// is in the range [min, max]. Entries without a value are not kept.
+func FilterRange(field string, min, max float64) Filter {
+	return func(query, entry Entry) bool {
+		v, ok := entry.Meta.FloatValue(field)
+		return ok && v >= min && v <= max
+	}
+}
+
+// FilterEqual keeps the entries whose value of the field given is equal to
+// value. Entries without a value are not kept. value must be a number or a
+// string, or FilterEqual will panic.
+func FilterEqual(field string, value interface{}) Filter {
+	norm, ok := filterValue(value)
+	if !ok {
+		panic(fmt.Sprintf("Cannot filter field '%s' by a value of type %T.",
+			field, value))
+	}
+	return func(query, entry Entry) bool {
+		v, ok := filterValue(entry.Meta[field])
+		return ok && v == norm
+	}
+}
+
+// FilterDifferent keeps the entries whose value of the field given is not
+// equal to the query's value. For example, if every entry has a field with
+// its CATH topology, FilterDifferent("topology") excludes the entries with
+// the same topology as the query. Entries are kept when either the entry or
+// the query has no value.
+func FilterDifferent(field string) Filter {
+	return func(query, entry Entry) bool {
+		qv, ok := query.Meta[field]
+		if !ok {
+			return true
+		}
+		ev, ok := entry.Meta[field]
+		return !ok || !metaEqual(ev, qv)
+	}
+}
+
+// metaEqual returns true if a metadata value is equal to the value given,
+// where numbers are equal if they have the same value, regardless of their
+// types. Values that are neither numbers nor strings are never equal.
+func metaEqual(v, value interface{}) bool {
+	n, ok := filterValue(v)
+	if !ok {
+		return false
+	}
+	m, ok := filterValue(value)
+	return ok && n == m
+}
+
+// filterValue converts a metadata value to a value that can be compared
+// with ==. Numbers are converted to float64. Values that are neither
+// numbers nor strings can't be compared.
+func filterValue(v interface{}) (interface{}, bool) {
+	if n, ok := normalizeValue(FieldFloat, v); ok {
+		return n, true
+	}
+	return normalizeValue(FieldString, v)
+}
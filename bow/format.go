@@ -0,0 +1,229 @@
+package bow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// dbMagic is the first thing written to every bow.db file with a header.
+// Databases created before the header was added start with the length of
+// their first entry, whose first byte is always less than 'B'.
+const dbMagic = "BOWDB\x00"
+
+// dbVersion is the version of the bow.db format written by this package.
+// Version 2 added variable width entries, version 3 added the sparse
+// encoding of variable width entries, version 4 added the data of each
+// entry and version 5 added the generation.
+const dbVersion = 5
+
+// The encodings of the BOW vectors in a bow.db file.
+const (
+	// Each frequency is a 16 bit integer.
+	encodingInt16 = iota
+
+	// Each weight is a 32 bit float. (Used for soft assignment.)
+	encodingFloat32
+
+	// Each entry has a byte after its Id with the number of bytes used by
+	// each frequency: 2 if every frequency fits in 16 bits and 4 otherwise.
+	// If the byte is 0, the BOW is sparse (see SparseBOW.encode), which is
+	// used whenever it is smaller.
+	encodingVarWidth
+)
+
+// dbHeader is the header at the start of a bow.db file. It describes the
+// fragment library used to build the database so that opening a database
+// with the wrong fragment library is an error, and records the number of
+// entries so that truncated files can be detected.
+//
+// The header is followed by the entries, where each entry is its length
+// (4 bytes), the entry (its null terminated Id, its data and its BOW vector)
+// and a CRC-32 checksum of the entry (4 bytes). The header itself ends with
+// a CRC-32 checksum of the header.
+type dbHeader struct {
+	Version  uint16
+	Encoding uint8
+	LibName  string
+	LibSize  uint32
+	FragSize uint32
+	Entries  uint64
+
+	// The number of times the database has been compacted. The files
+	// describing positions in bow.db (bow.del and bow.ids) record the
+	// generation they were written for, so that files left behind by an
+	// interrupted compaction are ignored. (Only stored since version 5.)
+	Generation uint64
+}
+
+// newHeader returns the header for a new database.
+func (db *DB) newHeader() *dbHeader {
+	encoding := encodingVarWidth
+	if db.Soft != nil {
+		encoding = encodingFloat32
+	}
+	return &dbHeader{
+		Version:  dbVersion,
+		Encoding: uint8(encoding),
+		LibName:  db.Lib.Name(),
+		LibSize:  uint32(db.Lib.Size()),
+		FragSize: uint32(db.Lib.FragmentLen()),
+	}
+}
+
+// encoding returns the encoding of the BOW vectors in the database. For
+// databases without a header, it is inferred from soft assignment options.
+func (db *DB) encoding() uint8 {
+	if db.header != nil {
+		return db.header.Encoding
+	}
+	if db.Soft != nil {
+		return encodingFloat32
+	}
+	return encodingInt16
+}
+
+// hasData returns true if the entries in the database have data. Databases
+// are always updated in the format they were created with, so the data of
+// entries added to older databases is not stored.
+func (db *DB) hasData() bool {
+	return db.header != nil && db.header.Version >= 4
+}
+
+// bytes returns the binary representation of the header.
+func (h *dbHeader) bytes() []byte {
+	endian := binary.BigEndian
+	buf := new(bytes.Buffer)
+	buf.WriteString(dbMagic)
+	binary.Write(buf, endian, h.Version)
+	binary.Write(buf, endian, h.Encoding)
+	binary.Write(buf, endian, uint16(len(h.LibName)))
+	buf.WriteString(h.LibName)
+	binary.Write(buf, endian, h.LibSize)
+	binary.Write(buf, endian, h.FragSize)
+	binary.Write(buf, endian, h.Entries)
+	if h.Version >= 5 {
+		binary.Write(buf, endian, h.Generation)
+	}
+	binary.Write(buf, endian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// writeHeader writes the header of a database being created to the start
+// of its bow.db file.
+func (db *DB) writeHeader() error {
+	db.header.Entries = uint64(db.records)
+	if _, err := db.file.WriteAt(db.header.bytes(), 0); err != nil {
+		return fmt.Errorf("Could not write header of '%s': %s",
+			db.filePath("bow.db"), err)
+	}
+	return nil
+}
+
+// readHeader reads the header of a bow.db file, and returns the header and
+// its length in bytes. If the file has no header, then the header returned
+// is nil.
+func readHeader(r *bufio.Reader) (*dbHeader, int, error) {
+	magic, err := r.Peek(len(dbMagic))
+	if err != nil || string(magic) != dbMagic {
+		// Either an empty file or a file without a header.
+		return nil, 0, nil
+	}
+
+	// Read everything through the library name so that the length of the
+	// rest of the header is known.
+	fixed := len(dbMagic) + 2 + 1 + 2
+	start, err := r.Peek(fixed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not read header: %s", err)
+	}
+	version := binary.BigEndian.Uint16(start[len(dbMagic):])
+	nameLen := int(binary.BigEndian.Uint16(start[fixed-2:]))
+	hlen := fixed + nameLen + 4 + 4 + 8 + 4
+	if version >= 5 {
+		hlen += 8
+	}
+
+	bs := make([]byte, hlen)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, 0, fmt.Errorf("Could not read header: %s", err)
+	}
+	sum := binary.BigEndian.Uint32(bs[hlen-4:])
+	if crc32.ChecksumIEEE(bs[:hlen-4]) != sum {
+		return nil, 0, fmt.Errorf("The header is corrupt (bad checksum).")
+	}
+
+	endian := binary.BigEndian
+	rest := bs[len(dbMagic):]
+	h := &dbHeader{}
+	h.Version = endian.Uint16(rest)
+	h.Encoding = rest[2]
+	h.LibName = string(rest[5 : 5+nameLen])
+	rest = rest[5+nameLen:]
+	h.LibSize = endian.Uint32(rest)
+	h.FragSize = endian.Uint32(rest[4:])
+	h.Entries = endian.Uint64(rest[8:])
+	if h.Version >= 5 {
+		h.Generation = endian.Uint64(rest[16:])
+	}
+	return h, hlen, nil
+}
+
+// generation returns the generation of the database's bow.db file, which is
+// 0 for files without a header or written before version 5.
+func (db *DB) generation() uint64 {
+	if db.header == nil {
+		return 0
+	}
+	return db.header.Generation
+}
+
+// readDBHeader reads and validates the header of the database's bow.db file,
+// if it has one.
+func (db *DB) readDBHeader() error {
+	fp := db.filePath("bow.db")
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h, hlen, err := readHeader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("Could not read '%s': %s", fp, err)
+	}
+	if h == nil {
+		return nil
+	}
+	if h.Version > dbVersion {
+		return fmt.Errorf("'%s' has format version %d, but only versions "+
+			"up to %d are supported.", fp, h.Version, dbVersion)
+	}
+	if h.LibName != db.Lib.Name() ||
+		int(h.LibSize) != db.Lib.Size() ||
+		int(h.FragSize) != db.Lib.FragmentLen() {
+		return fmt.Errorf("'%s' was built with the fragment library '%s' "+
+			"(size %d, fragment size %d), but the fragment library of the "+
+			"BOW database is '%s' (size %d, fragment size %d).", fp,
+			h.LibName, h.LibSize, h.FragSize,
+			db.Lib.Name(), db.Lib.Size(), db.Lib.FragmentLen())
+	}
+	if h.Encoding > encodingVarWidth {
+		return fmt.Errorf("'%s' has an unknown encoding %d.", fp, h.Encoding)
+	}
+	if (h.Encoding == encodingFloat32) != (db.Soft != nil) {
+		return fmt.Errorf("'%s' has encoding %d, which does not match the "+
+			"soft assignment options of the BOW database.", fp, h.Encoding)
+	}
+	db.header, db.headerLen = h, hlen
+	return nil
+}
+
+// checksum returns the checksum of a single entry.
+func checksum(entry []byte) uint32 {
+	return crc32.ChecksumIEEE(entry)
+}
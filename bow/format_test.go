@@ -0,0 +1,160 @@
+package bow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/bcbgo/fragbag"
+	"github.com/TuftsBCB/structure"
+)
+
+func TestHeader(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	mem := randomDB(rng, 100, 10)
+	for i := range mem.Entries {
+		mem.Entries[i].Data = fmt.Sprintf("data\x00%d", i)
+	}
+	mem.Entries[3].Data = ""
+
+	// Version 0 is a database without a header, databases before version 4
+	// have no data and headers before version 5 have no generation.
+	for _, version := range []int{dbVersion, 4, 3, 0} {
+		dir := saveDB(t, mem, version)
+		defer os.RemoveAll(path.Dir(dir))
+
+		db, err := OpenDB(dir)
+		if err != nil {
+			t.Fatalf("Version %d: %s", version, err)
+		}
+		if (db.header == nil) != (version == 0) {
+			t.Fatalf("Version %d: header is %v.", version, db.header)
+		}
+		if len(db.Entries) != len(mem.Entries) {
+			t.Fatalf("Version %d: read %d entries but expected %d.",
+				version, len(db.Entries), len(mem.Entries))
+		}
+		for i := range db.Entries {
+			data := mem.Entries[i].Data
+			if version < 4 {
+				data = ""
+			}
+			if db.Entries[i].Id != mem.Entries[i].Id ||
+				db.Entries[i].Data != data ||
+				!db.Entries[i].DenseBOW().Equal(mem.Entries[i].BOW) {
+				t.Fatalf("Version %d: entry %d differs.", version, i)
+			}
+		}
+		if version > 0 && db.header.Entries != uint64(len(mem.Entries)) {
+			t.Fatalf("Header has %d entries but expected %d.",
+				db.header.Entries, len(mem.Entries))
+		}
+	}
+}
+
+// expectOpenError checks that opening the database in dir fails with an
+// error containing the string given.
+func expectOpenError(t *testing.T, dir, contains string) {
+	_, err := OpenDB(dir)
+	if err == nil {
+		t.Fatalf("Expected an error containing '%s' but got none.", contains)
+	}
+	if !strings.Contains(err.Error(), contains) {
+		t.Fatalf("Expected an error containing '%s' but got: %s",
+			contains, err)
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	mem := randomDB(rng, 100, 10)
+	dir := saveDB(t, mem, dbVersion)
+	defer os.RemoveAll(path.Dir(dir))
+
+	fp := path.Join(dir, "bow.db")
+	original, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the last entry.
+	corrupt := append([]byte{}, original...)
+	corrupt[len(corrupt)-6] ^= 1
+	if err := ioutil.WriteFile(fp, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	expectOpenError(t, dir, "bad checksum")
+
+	// Drop the last entry. Each entry is its length, the entry itself and
+	// its checksum.
+	_, last, err := readHeader(bufio.NewReader(bytes.NewReader(original)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		next := last + 4 + int(readUint32(original[last:])) + 4
+		if next == len(original) {
+			break
+		}
+		last = next
+	}
+	truncated := original[:last]
+	if err := ioutil.WriteFile(fp, truncated, 0666); err != nil {
+		t.Fatal(err)
+	}
+	expectOpenError(t, dir, "truncated")
+
+	// Use a fragment library with a different size.
+	if err := ioutil.WriteFile(fp, original, 0666); err != nil {
+		t.Fatal(err)
+	}
+	lib := fragbag.NewStructureLibrary("random")
+	lib.Add([]structure.Coords{{}})
+	libf, err := os.Create(path.Join(dir, "frag.lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Save(libf); err != nil {
+		t.Fatal(err)
+	}
+	libf.Close()
+	expectOpenError(t, dir, "fragment library")
+}
+
+func TestWideFrequencies(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	mem := randomDB(rng, 50, 10)
+	mem.Entries[7].BOW.Freqs[3] = 70000
+	mem.Entries[9].BOW.Freqs[0] = 1 << 31
+
+	dir := saveDB(t, mem, dbVersion)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range db.Entries {
+		if !db.Entries[i].DenseBOW().Equal(mem.Entries[i].BOW) {
+			t.Fatalf("Entry %d is %s but expected %s.",
+				i, db.Entries[i].BOW, mem.Entries[i].BOW)
+		}
+	}
+
+	// Databases with 16 bit frequencies must refuse wide frequencies.
+	legacy := &DB{Lib: mem.Lib, writeBuf: new(bytes.Buffer)}
+	if legacy.file, err = ioutil.TempFile("", "bowdb"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(legacy.file.Name())
+	defer legacy.file.Close()
+	if err := legacy.write(mem.Entries[7]); err == nil {
+		t.Fatalf("Expected an error writing a frequency of %d.",
+			mem.Entries[7].BOW.Freqs[3])
+	}
+}
@@ -0,0 +1,278 @@
+package bow
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The policies for adding a value to a BOW database when an entry with the
+// same Id has already been added. (See DB.Duplicates.)
+const (
+	// Add returns an error for the value, which is not added.
+	DuplicateReject = iota
+
+	// The value replaces the existing entry. If several values with the
+	// same Id are added, the last one added is kept.
+	DuplicateReplace
+)
+
+// idRecord is the location in bow.db of the entry with a particular Id.
+// Every BOW database has a list of id records sorted by Id in 'bow.ids',
+// so that entries can be found without reading every entry.
+type idRecord struct {
+	Id       string
+	Offset   int64
+	Position int
+
+	// The sequence number of the job that computed the entry, or -1 if the
+	// entry was in the database before it was opened. (Not stored.)
+	seq int
+}
+
+// Has returns true if the database has an entry with the given Id.
+//
+// If the database was opened with OpenDBStream and its Id index can't be
+// read, Has returns false. (Get returns the error.)
+func (db *DB) Has(id string) bool {
+	if !db.stream {
+		_, ok := db.entryById(id)
+		return ok
+	}
+	_, ok, _ := db.lookupId(id)
+	return ok
+}
+
+// Get returns the entry with the given Id. If there is no such entry, an
+// error is returned.
+//
+// If the database was opened with OpenDBStream, only the entry is read
+// from disk.
+func (db *DB) Get(id string) (Entry, error) {
+	notFound := fmt.Errorf("There is no entry with Id '%s' in the BOW "+
+		"database '%s'.", id, db)
+	if !db.stream {
+		entry, ok := db.entryById(id)
+		if !ok {
+			return Entry{}, notFound
+		}
+		return entry, nil
+	}
+
+	rec, ok, err := db.lookupId(id)
+	if err != nil {
+		return Entry{}, err
+	} else if !ok {
+		return Entry{}, notFound
+	}
+	return db.readAt(rec)
+}
+
+// SearchId searches the database for the neighbors of the entry with the
+// given Id, which is returned as the first result (unless the search options
+// exclude it). An error is returned if there is no such entry.
+func (db *DB) SearchId(opts SearchOptions, id string) ([]SearchResult, error) {
+	query, err := db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return db.SearchStream(opts, query)
+}
+
+// entryById returns the entry in memory with the given Id. The map from Ids
+// to indices in db.Entries is built the first time it's needed, and again
+// after db.Entries changes.
+func (db *DB) entryById(id string) (Entry, bool) {
+	if db.updating {
+		db.updateLock.Lock()
+		defer db.updateLock.Unlock()
+	}
+	db.idLock.Lock()
+	defer db.idLock.Unlock()
+
+	if db.byId == nil {
+		db.byId = make(map[string]int, len(db.Entries))
+		for i, entry := range db.Entries {
+			if _, ok := db.byId[entry.Id]; !ok {
+				db.byId[entry.Id] = i
+			}
+		}
+	}
+	i, ok := db.byId[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return db.Entries[i], true
+}
+
+// entriesChanged must be called after db.Entries or db.DocFreqs is
+// modified, with db.updateLock held. It discards everything computed from
+// the entries: the map from Ids to indices, the weighted entries and the
+// index.
+func (db *DB) entriesChanged() {
+	db.idLock.Lock()
+	db.byId = nil
+	db.idLock.Unlock()
+
+	db.weightedLock.Lock()
+	db.weighted = nil
+	db.weightedLock.Unlock()
+
+	db.Index = nil
+}
+
+// lookupId finds the id record of the entry with the given Id in a
+// database opened with OpenDBStream. The id records are read from 'bow.ids',
+// or computed by reading every entry if it doesn't exist.
+func (db *DB) lookupId(id string) (idRecord, bool, error) {
+	db.idLock.Lock()
+	defer db.idLock.Unlock()
+
+	if db.idRecords == nil {
+		recs, err := db.readIds()
+		if err != nil {
+			return idRecord{}, false, err
+		}
+		db.idRecords = recs
+	}
+	recs := db.idRecords
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].Id >= id })
+	if i < len(recs) && recs[i].Id == id {
+		return recs[i], true, nil
+	}
+	return idRecord{}, false, nil
+}
+
+// readAt reads the entry with the given id record from disk.
+func (db *DB) readAt(rec idRecord) (Entry, error) {
+	fp := db.filePath("bow.db")
+	f, err := os.Open(fp)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+
+	var buf []byte
+	r := io.NewSectionReader(f, rec.Offset, 1<<62)
+	entry, _, err := db.readRecord(r, &buf, rec.Position)
+	if err != nil {
+		return Entry{}, fmt.Errorf("Could not read entry '%s' in '%s': %s",
+			rec.Id, fp, err)
+	}
+	if entry.Id != rec.Id {
+		return Entry{}, fmt.Errorf("The Id index of '%s' is out of date. "+
+			"Expected entry '%s' but found '%s'.", fp, rec.Id, entry.Id)
+	}
+	return entry, nil
+}
+
+// readIds reads the id records of the database, sorted by Id. If there is
+// no 'bow.ids' (i.e., for databases created before it existed) or it was
+// written for another generation of bow.db, they are computed by reading
+// every entry. When there are several entries with the same Id, the first
+// one is used.
+func (db *DB) readIds() ([]idRecord, error) {
+	f, err := os.Open(db.filePath("bow.ids"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return db.scanIds()
+	}
+	defer f.Close()
+
+	var gen uint64
+	var recs []idRecord
+	dec := gob.NewDecoder(f)
+	if err := dec.Decode(&gen); err != nil {
+		return nil, fmt.Errorf("Could not read Id index: %s", err)
+	}
+	if gen != db.generation() {
+		// Left behind by an interrupted compaction.
+		return db.scanIds()
+	}
+	if err := dec.Decode(&recs); err != nil {
+		return nil, fmt.Errorf("Could not read Id index: %s", err)
+	}
+	return recs, nil
+}
+
+// scanIds computes the id records of the database by reading every entry.
+func (db *DB) scanIds() ([]idRecord, error) {
+	ids := make(map[string]idRecord)
+	it := db.iterFile()
+	for it.Next() {
+		id := it.Entry().Id
+		if _, ok := ids[id]; !ok {
+			ids[id] = idRecord{id, it.offset, it.Index(), -1}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return sortedIds(ids), nil
+}
+
+// writeIds writes the id records of a database being written to 'bow.ids'.
+func (db *DB) writeIds() error {
+	f, err := db.createFile("bow.ids")
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(db.generation())
+	if err == nil {
+		err = enc.Encode(sortedIds(db.ids))
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write Id index: %s", err)
+	}
+	return closeFile(f)
+}
+
+func sortedIds(ids map[string]idRecord) []idRecord {
+	recs := make([]idRecord, 0, len(ids))
+	for _, rec := range ids {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Id < recs[j].Id })
+	return recs
+}
+
+// checkDuplicate returns an error if a value with the given Id can't be
+// added to the database because of its duplicate policy. Otherwise, the Id
+// is recorded as added. db.seqLock must be held.
+func (db *DB) checkDuplicate(id string) error {
+	if db.submitted[id] && db.Duplicates == DuplicateReject {
+		return fmt.Errorf("An entry with Id '%s' has already been added to "+
+			"the BOW database '%s'.", id, db)
+	}
+	db.submitted[id] = true
+	return nil
+}
+
+// replaced removes the entry with the given id record after another entry
+// with the same Id has been written. db.updateLock must be held.
+func (db *DB) replaced(old idRecord) error {
+	db.deleted[old.Position] = true
+	if db.updating {
+		db.removeWhere(func(i int) bool {
+			return db.positions[i] == old.Position
+		})
+		return nil
+	}
+
+	// The entry isn't in memory, so read it back to update the document
+	// frequencies.
+	var buf []byte
+	r := io.NewSectionReader(db.file, old.Offset, 1<<62)
+	entry, _, err := db.readRecord(r, &buf, old.Position)
+	if err != nil {
+		return fmt.Errorf("Could not read replaced entry '%s': %s", old.Id, err)
+	}
+	db.DocFreqs.Remove(entry)
+	return nil
+}
@@ -0,0 +1,198 @@
+package bow
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDuplicates(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	chains := make([]chain, 10)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := CreateDB(library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chains {
+		if err := db.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Add(randomChain(rng, "c04")); err == nil {
+		t.Fatalf("Adding a duplicate Id did not return an error.")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+
+	// With the replace policy, the last value added for an Id is kept, even
+	// if the values are written out of order.
+	dir = tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	if db, err = CreateDB(library, dir); err != nil {
+		t.Fatal(err)
+	}
+	db.Duplicates = DuplicateReplace
+	for round := 0; round < 3; round++ {
+		for i := range chains {
+			chains[i] = randomChain(rng, chains[i].id)
+			if err := db.Add(chains[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+
+	// The same holds when updating a database.
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add(randomChain(rng, "c02")); err == nil {
+		t.Fatalf("Adding a duplicate Id did not return an error.")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	db.Duplicates = DuplicateReplace
+	chains[2] = randomChain(rng, "c02")
+	if err := db.Add(chains[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, db, chains)
+}
+
+// checkGet checks that every chain can be found by Id in the database, and
+// that Ids not in the database can't.
+func checkGet(t *testing.T, db *DB, chains []chain) {
+	for _, c := range chains {
+		if !db.Has(c.id) {
+			t.Fatalf("Could not find entry '%s'.", c.id)
+		}
+		entry, err := db.Get(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ComputeBOW(library, c)
+		if entry.Id != c.id || entry.Data != c.data ||
+			!entry.DenseBOW().Equal(expected) {
+			t.Fatalf("Entry '%s' is '%s' with BOW %s but expected %s.",
+				c.id, entry.Id, entry.DenseBOW(), expected)
+		}
+	}
+	if db.Has("missing") {
+		t.Fatalf("Found an entry that is not in the database.")
+	}
+	if _, err := db.Get("missing"); err == nil {
+		t.Fatalf("Got an entry that is not in the database.")
+	}
+}
+
+func TestGet(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+	chains := make([]chain, 30)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	check := func() {
+		loaded, err := OpenDB(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGet(t, loaded, chains)
+		stream, err := OpenDBStream(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGet(t, stream, chains)
+
+		opts := SearchDefault
+		opts.Limit = -1
+		got, err := stream.SearchId(opts, "c07")
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := loaded.Get("c07")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := mustSearch(t, loaded, opts, query)
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %d results but got %d.",
+				len(expected), len(got))
+		}
+		for i := range expected {
+			if got[i].Id != expected[i].Id || got[i].Data != expected[i].Data {
+				t.Fatalf("Result %d is '%s' but expected '%s'.",
+					i, got[i].Id, expected[i].Id)
+			}
+		}
+		if got[0].Data != "data for c07" {
+			t.Fatalf("The first result has data '%s' but expected '%s'.",
+				got[0].Data, "data for c07")
+		}
+		if _, err := stream.SearchId(opts, "missing"); err == nil {
+			t.Fatalf("Searched for an entry that is not in the database.")
+		}
+	}
+	check()
+
+	// The Id index is kept up to date by updates and compaction.
+	db, err := OpenDBUpdate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("c03")
+	chains[5] = randomChain(rng, "c05")
+	if err := db.Replace(chains[5]); err != nil {
+		t.Fatal(err)
+	}
+	chains[3] = randomChain(rng, "c30")
+	if err := db.Add(chains[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := CompactDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// Databases without an Id index are still searchable by Id.
+	if err := os.Remove(path.Join(dir, "bow.ids")); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
@@ -0,0 +1,467 @@
+package bow
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// The parameters of the random hyperplane LSH index for cosine distance.
+// Each of lshTables tables hashes an entry to a bucket with lshBits bits.
+const (
+	lshTables = 8
+	lshBits   = 16
+)
+
+// indexEpsilon is the slack given when pruning with the triangle inequality,
+// to guard against rounding errors.
+const indexEpsilon = 1e-9
+
+// Index is an optional nearest neighbor index for a BOW database, which is
+// stored in the database directory as 'bow.idx'. When a database has an
+// index, searches sorted by the euclidean or cosine distance in ascending
+// order (and without weighting) use it instead of scanning every entry.
+//
+// Searches that use the index are exact unless SearchOptions.Budget is in
+// the range (0, 1), in which case they are approximate.
+//
+// The index contains a vantage point tree for euclidean distance, a vantage
+// point tree for cosine distance and a random hyperplane LSH index for
+// cosine distance. The vantage point tree for cosine distance uses the
+// euclidean distance between normalized BOWs, which is sqrt(2 * cosine) and
+// is a metric. The LSH index is only used for approximate searches.
+type Index struct {
+	// The number of entries in the database when the index was built, and
+	// the seed used to build it.
+	Entries int
+	Seed    int64
+
+	Euclid *vpTree
+	Cosine *vpTree
+	LSH    *lshIndex
+}
+
+// BuildIndex builds a nearest neighbor index for every entry in the database
+// and writes it to the database directory. The seed determines the random
+// choices made when building the index.
+//
+// BuildIndex can only be called on a database opened with OpenDB.
+func (db *DB) BuildIndex(seed int64) error {
+	if db.writing != nil || db.stream {
+		return fmt.Errorf("Cannot index BOW database '%s' unless it is "+
+			"opened with OpenDB.", db)
+	}
+	db.Index = db.buildIndex(seed)
+	return db.writeIndex()
+}
+
+// writeIndex writes the index of the database to its directory.
+func (db *DB) writeIndex() error {
+	f, err := db.createFile("bow.idx")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(db.Index); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write index: %s", err)
+	}
+	return closeFile(f)
+}
+
+func (db *DB) buildIndex(seed int64) *Index {
+	rng := rand.New(rand.NewSource(seed))
+	return &Index{
+		Entries: len(db.Entries),
+		Seed:    seed,
+		Euclid:  newVPTree(db.Entries, false, rng),
+		Cosine:  newVPTree(db.Entries, true, rng),
+		LSH:     newLSHIndex(db.Entries, db.Lib.Size(), rng),
+	}
+}
+
+// readIndex reads the index of the database if it exists. An error is
+// returned if the index does not match the entries in the database.
+func (db *DB) readIndex() (*Index, error) {
+	f, err := os.Open(db.filePath("bow.idx"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var idx Index
+	if err := gob.NewDecoder(f).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("Could not read index: %s", err)
+	}
+	if idx.Entries != len(db.Entries) {
+		return nil, fmt.Errorf("The index has %d entries but the BOW "+
+			"database has %d entries. Please rebuild the index.",
+			idx.Entries, len(db.Entries))
+	}
+	return &idx, nil
+}
+
+// MeasureRecall returns the fraction of results found by searching for each
+// query with the options given, relative to the results found by scanning
+// every entry. This is useful for choosing a value of SearchOptions.Budget.
+//
+// An error is returned if the database has no index, or if the index can't
+// be used with the options given.
+func (db *DB) MeasureRecall(
+	opts SearchOptions,
+	queries []Entry,
+) (float64, error) {
+	if db.updating {
+		db.updateLock.Lock()
+		defer db.updateLock.Unlock()
+	}
+	if !db.canSearchIndex(opts) {
+		return 0, fmt.Errorf("The index of BOW database '%s' can't be used "+
+			"for a search by %s with weighting %d and order %d.",
+			db, opts.SortBy.Name(), opts.Weighting, opts.Order)
+	}
+
+	wentries := db.weightedEntries(opts.Weighting)
+	found, total := 0, 0
+	for _, query := range queries {
+		wquery := db.DocFreqs.Weigh(opts.Weighting, query)
+		exact := db.searchEntry(opts, wquery, wentries, 1)
+		got := make(map[string]int)
+		for _, h := range db.searchEntryIndex(opts, wquery) {
+			got[h.Id]++
+		}
+		for _, r := range exact {
+			if got[r.Id] > 0 {
+				got[r.Id]--
+				found++
+			}
+		}
+		total += len(exact)
+	}
+	if total == 0 {
+		return 1.0, nil
+	}
+	return float64(found) / float64(total), nil
+}
+
+// searchIndex searches the database using its index. If the index cannot
+// be used for the options given, ok is false.
+func (db *DB) searchIndex(
+	opts SearchOptions,
+	query Entry,
+) (results []SearchResult, ok bool) {
+	if !db.canSearchIndex(opts) {
+		return nil, false
+	}
+	hits := db.searchEntryIndex(opts, query)
+	return db.results(opts, query, db.Entries, hits), true
+}
+
+// canSearchIndex returns true if the database has an index that can be used
+// for a search with the options given.
+func (db *DB) canSearchIndex(opts SearchOptions) bool {
+	if db.Index == nil || opts.Weighting != WeightNone ||
+		opts.Order != OrderAsc {
+		return false
+	}
+	return opts.SortBy == Euclid || opts.SortBy == Cosine
+}
+
+// searchEntryIndex returns the best hits for the query using the index.
+// The options given must be supported by the index.
+func (db *DB) searchEntryIndex(opts SearchOptions, query Entry) []hit {
+	budget := len(db.Entries)
+	approx := opts.Budget > 0 && opts.Budget < 1
+	if approx {
+		budget = int(math.Ceil(opts.Budget * float64(len(db.Entries))))
+	}
+
+	best := newTopK(opts.Limit, opts.Order)
+	switch {
+	case opts.SortBy == Cosine && approx:
+		db.Index.LSH.search(db, opts, query, best, budget)
+	case opts.SortBy == Cosine:
+		db.Index.Cosine.search(db, opts, query, best, budget)
+	default:
+		db.Index.Euclid.search(db, opts, query, best, budget)
+	}
+	return best.sorted()
+}
+
+// consider adds the entry at the given index to best if it satisfies the
+// thresholds and filters in the options given.
+func (db *DB) consider(opts SearchOptions, query Entry, i int, best *topk) {
+	if !opts.keep(query, db.Entries[i]) {
+		return
+	}
+	dist := opts.SortBy.Distance(query, db.Entries[i])
+	if dist > opts.Max || dist < opts.Min {
+		return
+	}
+	best.add(hit{db.Entries[i], dist, i})
+}
+
+// A vpMetric is a true metric (satisfying the triangle inequality) used to
+// build a vantage point tree. toMetric converts a distance reported by the
+// corresponding search Metric to a distance in this metric.
+type vpMetric struct {
+	dist     func(e1, e2 Entry) float64
+	toMetric func(d float64) float64
+}
+
+var euclidMetric = vpMetric{
+	dist:     func(e1, e2 Entry) float64 { return e1.Euclid(e2) },
+	toMetric: func(d float64) float64 { return d },
+}
+
+var cosineMetric = vpMetric{
+	dist: func(e1, e2 Entry) float64 {
+		return math.Sqrt(2 * math.Max(0, e1.Cosine(e2)))
+	},
+	toMetric: func(d float64) float64 { return math.Sqrt(2 * math.Max(0, d)) },
+}
+
+// vpTree is a vantage point tree. Each node has a vantage point (an entry),
+// and the entries of its subtree other than the vantage point are split into
+// those within a distance of Mu of the vantage point (Inside) and those at
+// least Mu away (Outside).
+//
+// Nodes are stored in a flat list so that the tree is easy to serialize.
+type vpTree struct {
+	Cosine bool
+	Nodes  []vpNode
+	Root   int
+
+	// Entries that are not in the tree, and must always be checked.
+	// For cosine distance, these are entries with an empty BOW, since the
+	// distance between normalized BOWs isn't defined for them.
+	Unindexed []int
+}
+
+type vpNode struct {
+	Vantage         int
+	Mu              float64
+	Inside, Outside int
+}
+
+func (t *vpTree) metric() vpMetric {
+	if t.Cosine {
+		return cosineMetric
+	}
+	return euclidMetric
+}
+
+func newVPTree(entries []Entry, cosine bool, rng *rand.Rand) *vpTree {
+	t := &vpTree{Cosine: cosine}
+	indices := make([]int, 0, len(entries))
+	for i, entry := range entries {
+		if t.Cosine && entry.weighted().Magnitude() == 0 {
+			t.Unindexed = append(t.Unindexed, i)
+			continue
+		}
+		indices = append(indices, i)
+	}
+	t.Root = t.build(entries, t.metric(), indices, rng)
+	return t
+}
+
+// build builds the subtree for the entries given and returns the index of
+// its root node, or -1 if there are no entries.
+func (t *vpTree) build(
+	entries []Entry,
+	metric vpMetric,
+	indices []int,
+	rng *rand.Rand,
+) int {
+	if len(indices) == 0 {
+		return -1
+	}
+
+	// Pick a random vantage point and move it to the front.
+	v := rng.Intn(len(indices))
+	indices[0], indices[v] = indices[v], indices[0]
+	vantage, rest := indices[0], indices[1:]
+
+	dists := make(map[int]float64, len(rest))
+	for _, i := range rest {
+		dists[i] = metric.dist(entries[vantage], entries[i])
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return dists[rest[i]] < dists[rest[j]]
+	})
+
+	// Entries with distances equal to the median must all go to the
+	// outside, since the inside is strictly less than Mu.
+	mid := len(rest) / 2
+	mu := 0.0
+	if len(rest) > 0 {
+		mu = dists[rest[mid]]
+		for mid > 0 && dists[rest[mid-1]] == mu {
+			mid--
+		}
+	}
+
+	node := len(t.Nodes)
+	t.Nodes = append(t.Nodes, vpNode{Vantage: vantage, Mu: mu})
+	inside := t.build(entries, metric, rest[:mid], rng)
+	outside := t.build(entries, metric, rest[mid:], rng)
+	t.Nodes[node].Inside, t.Nodes[node].Outside = inside, outside
+	return node
+}
+
+// search adds the entries nearest to the query to best. At most `budget`
+// distances are computed, which makes the search approximate when `budget`
+// is less than the number of entries.
+//
+// Subtrees are only pruned when the triangle inequality guarantees that
+// none of their entries are closer than the current worst result, so that
+// ties are never pruned.
+func (t *vpTree) search(
+	db *DB,
+	opts SearchOptions,
+	query Entry,
+	best *topk,
+	budget int,
+) {
+	metric := t.metric()
+	checks := 0
+	for _, i := range t.Unindexed {
+		db.consider(opts, query, i, best)
+		checks++
+	}
+
+	// tau is the largest distance (in the tree's metric) that a result
+	// could have.
+	tau := func() float64 {
+		if best.limit >= 0 && len(best.hits) == best.limit {
+			if best.limit == 0 {
+				return -1
+			}
+			return metric.toMetric(best.hits[0].distance)
+		}
+		if opts.Max == math.MaxFloat64 {
+			return math.Inf(1)
+		}
+		return metric.toMetric(opts.Max)
+	}
+
+	var visit func(n int)
+	visit = func(n int) {
+		if n < 0 || checks >= budget {
+			return
+		}
+		node := t.Nodes[n]
+		d := metric.dist(query, db.Entries[node.Vantage])
+		db.consider(opts, query, node.Vantage, best)
+		checks++
+
+		visitInside := func() {
+			if d-tau() <= node.Mu+indexEpsilon {
+				visit(node.Inside)
+			}
+		}
+		visitOutside := func() {
+			if d+tau() >= node.Mu-indexEpsilon {
+				visit(node.Outside)
+			}
+		}
+		if d < node.Mu {
+			visitInside()
+			visitOutside()
+		} else {
+			visitOutside()
+			visitInside()
+		}
+	}
+	visit(t.Root)
+}
+
+// lshIndex is a random hyperplane locality sensitive hashing index for
+// cosine distance. Each table hashes a BOW to a bucket using the signs of its
+// dot products with lshBits random hyperplanes.
+type lshIndex struct {
+	Planes  [][][]float64
+	Buckets []map[uint64][]int
+}
+
+func newLSHIndex(entries []Entry, size int, rng *rand.Rand) *lshIndex {
+	idx := &lshIndex{
+		Planes:  make([][][]float64, lshTables),
+		Buckets: make([]map[uint64][]int, lshTables),
+	}
+	for t := range idx.Planes {
+		idx.Planes[t] = make([][]float64, lshBits)
+		for b := range idx.Planes[t] {
+			plane := make([]float64, size)
+			for i := range plane {
+				plane[i] = rng.NormFloat64()
+			}
+			idx.Planes[t][b] = plane
+		}
+		idx.Buckets[t] = make(map[uint64][]int)
+	}
+	for i, entry := range entries {
+		w := entry.weighted()
+		for t := range idx.Planes {
+			h := idx.hash(t, w)
+			idx.Buckets[t][h] = append(idx.Buckets[t][h], i)
+		}
+	}
+	return idx
+}
+
+func (idx *lshIndex) hash(table int, w WeightedBOW) uint64 {
+	var h uint64
+	for b, plane := range idx.Planes[table] {
+		dot := 0.0
+		for i, x := range w.Weights {
+			dot += x * plane[i]
+		}
+		if dot >= 0 {
+			h |= 1 << uint(b)
+		}
+	}
+	return h
+}
+
+// search adds the entries nearest to the query among the candidates found
+// in the query's buckets to best. If there are fewer than `budget`
+// candidates, buckets that differ from the query's buckets by a single bit
+// are also probed.
+func (idx *lshIndex) search(
+	db *DB,
+	opts SearchOptions,
+	query Entry,
+	best *topk,
+	budget int,
+) {
+	w := query.weighted()
+	hashes := make([]uint64, len(idx.Planes))
+	for t := range idx.Planes {
+		hashes[t] = idx.hash(t, w)
+	}
+
+	seen := make(map[int]bool)
+	probe := func(t int, h uint64) {
+		for _, i := range idx.Buckets[t][h] {
+			if len(seen) >= budget || seen[i] {
+				continue
+			}
+			seen[i] = true
+			db.consider(opts, query, i, best)
+		}
+	}
+	for t, h := range hashes {
+		probe(t, h)
+	}
+	for b := 0; b < lshBits && len(seen) < budget; b++ {
+		for t, h := range hashes {
+			probe(t, h^(1<<uint(b)))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package bow
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestIndexExact(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for trial := 0; trial < 200; trial++ {
+		db := randomDB(rng, 1+rng.Intn(500), 1+rng.Intn(8))
+		db.Index = db.buildIndex(rng.Int63())
+		query := db.Entries[rng.Intn(len(db.Entries))]
+
+		opts := SearchDefault
+		opts.Limit = rng.Intn(40) - 5
+		opts.SortBy = []Metric{Euclid, Cosine}[rng.Intn(2)]
+		if rng.Intn(3) == 0 {
+			opts.Max = rng.Float64()
+		}
+		if rng.Intn(3) == 0 {
+			opts.Min = rng.Float64() / 4
+		}
+
+		expected := fullSort(db, opts, query)
+		got, ok := db.searchIndex(opts, query)
+		if !ok {
+			t.Fatalf("Trial %d: index was not used.", trial)
+		}
+		if len(expected) != len(got) {
+			t.Fatalf("Trial %d (%s): expected %d results but got %d.",
+				trial, opts.SortBy.Name(), len(expected), len(got))
+		}
+		for i := range expected {
+			if expected[i].Id != got[i].Id ||
+				expected[i].distance != got[i].Distance {
+				t.Fatalf("Trial %d (%s, limit %d): result %d is "+
+					"(%s, %f) but expected (%s, %f).",
+					trial, opts.SortBy.Name(), opts.Limit, i,
+					got[i].Id, got[i].Distance,
+					expected[i].Id, expected[i].distance)
+			}
+		}
+	}
+}
+
+// TestIndexRecall checks recall on random BOWs. Recall on SABmark is
+// measured by experiments/cmd/index-recall instead, since the tree doesn't
+// include the SABmark data.
+func TestIndexRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	db := randomDB(rng, 2000, 50)
+	db.Index = db.buildIndex(1)
+
+	queries := make([]Entry, 20)
+	for i := range queries {
+		queries[i] = db.Entries[rng.Intn(len(db.Entries))]
+	}
+	for _, metric := range []Metric{Euclid, Cosine} {
+		opts := SearchDefault
+		opts.SortBy = metric
+		opts.Limit = 10
+		if r, err := db.MeasureRecall(opts, queries); err != nil || r != 1 {
+			t.Fatalf("Exact %s search has recall %f (%v).",
+				metric.Name(), r, err)
+		}
+
+		opts.Budget = 0.2
+		r, err := db.MeasureRecall(opts, queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r <= 0 || r > 1 {
+			t.Fatalf("Approximate %s search has recall %f.",
+				metric.Name(), r)
+		}
+		t.Logf("Approximate %s search with budget %f has recall %f.",
+			metric.Name(), opts.Budget, r)
+	}
+
+	// Recall can't be measured for searches that don't use the index.
+	opts := SearchDefault
+	opts.SortBy = Manhattan
+	if _, err := db.MeasureRecall(opts, queries); err == nil {
+		t.Fatalf("Measured recall of a Manhattan search.")
+	}
+	opts.SortBy, opts.Weighting = Cosine, WeightTFIDF
+	if _, err := db.MeasureRecall(opts, queries); err == nil {
+		t.Fatalf("Measured recall of a weighted search.")
+	}
+}
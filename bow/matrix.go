@@ -0,0 +1,321 @@
+package bow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// matrixBlock is the number of rows (and columns) in each tile of a distance
+// matrix computed by one goroutine at a time. Computing tiles keeps the
+// BOWs of both rows and columns in cache.
+const matrixBlock = 64
+
+// matrixMagic starts every distance matrix written with WriteBinary.
+var matrixMagic = []byte("BOWMAT")
+
+const matrixVersion = 1
+
+// matrixPrealloc is the largest number of Ids or distances allocated up front
+// when reading a matrix. Anything bigger grows as it is read.
+const matrixPrealloc = 1 << 20
+
+// Matrix is a matrix of distances between the entries of one BOW database
+// (the rows) and the entries of another BOW database (the columns).
+//
+// When a matrix is computed for the entries of a single database against
+// themselves, it is symmetric and only its upper triangle (including the
+// diagonal) is stored.
+type Matrix struct {
+	// The name of the metric used to compute distances.
+	Metric string
+
+	// The Ids of the entries corresponding to each row and column.
+	// For a symmetric matrix, Rows and Cols are the same.
+	Rows, Cols []string
+
+	// Symmetric is true when only the upper triangle is stored.
+	Symmetric bool
+
+	// Distances in row major order. For a symmetric matrix, only entries
+	// (i, j) with i <= j are stored.
+	Dists []float32
+}
+
+// Matrix computes the distance between every pair of entries in the database
+// with the metric and weighting scheme given. Since the distances are
+// symmetric, only the upper triangle of the matrix is computed.
+//
+// The work is split across GOMAXPROCS goroutines.
+//
+// Matrix will panic if the database was opened with OpenDBStream.
+func (db *DB) Matrix(metric Metric, weighting int) *Matrix {
+	db.mustLoad()
+	entries := db.weightedEntries(weighting)
+	ids := entryIds(db.Entries)
+	n := len(entries)
+	m := &Matrix{
+		Metric:    metric.Name(),
+		Rows:      ids,
+		Cols:      ids,
+		Symmetric: true,
+		Dists:     make([]float32, n*(n+1)/2),
+	}
+	m.compute(metric, entries, entries)
+	return m
+}
+
+// MatrixWith computes the distance between every entry in db (the rows) and
+// every entry in other (the columns) with the metric and weighting scheme
+// given. When weighting is used, the document frequencies of db are applied
+// to the entries of both databases.
+//
+// An error is returned if the databases use different fragment libraries.
+// MatrixWith will panic if either database was opened with OpenDBStream.
+func (db *DB) MatrixWith(
+	other *DB,
+	metric Metric,
+	weighting int,
+) (*Matrix, error) {
+	db.mustLoad()
+	other.mustLoad()
+	if db.Lib.Name() != other.Lib.Name() ||
+		db.Lib.Size() != other.Lib.Size() ||
+		db.Lib.FragmentLen() != other.Lib.FragmentLen() {
+		return nil, fmt.Errorf("BOW databases '%s' and '%s' use different "+
+			"fragment libraries: %s and %s.", db, other, db.Lib, other.Lib)
+	}
+
+	rows := db.weightedEntries(weighting)
+	cols := other.Entries
+	if weighting != WeightNone {
+		cols = make([]Entry, len(other.Entries))
+		for i, entry := range other.Entries {
+			cols[i] = db.DocFreqs.Weigh(weighting, entry)
+		}
+	}
+	m := &Matrix{
+		Metric: metric.Name(),
+		Rows:   entryIds(db.Entries),
+		Cols:   entryIds(other.Entries),
+		Dists:  make([]float32, len(rows)*len(cols)),
+	}
+	m.compute(metric, rows, cols)
+	return m, nil
+}
+
+// compute fills in the distances of the matrix. Tiles of the matrix are
+// handed out to GOMAXPROCS goroutines.
+func (m *Matrix) compute(metric Metric, rows, cols []Entry) {
+	type tile struct{ row, col int }
+
+	tiles := make(chan tile)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < max(1, runtime.GOMAXPROCS(0)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				rowEnd := min(len(rows), t.row+matrixBlock)
+				colEnd := min(len(cols), t.col+matrixBlock)
+				for i := t.row; i < rowEnd; i++ {
+					j := t.col
+					if m.Symmetric && j < i {
+						j = i
+					}
+					for ; j < colEnd; j++ {
+						m.Dists[m.index(i, j)] =
+							float32(metric.Distance(rows[i], cols[j]))
+					}
+				}
+			}
+		}()
+	}
+	for row := 0; row < len(rows); row += matrixBlock {
+		col := 0
+		if m.Symmetric {
+			col = row
+		}
+		for ; col < len(cols); col += matrixBlock {
+			tiles <- tile{row, col}
+		}
+	}
+	close(tiles)
+	wg.Wait()
+}
+
+// index returns the position of the distance at (i, j) in Dists. For a
+// symmetric matrix, i must be less than or equal to j.
+func (m *Matrix) index(i, j int) int {
+	if m.Symmetric {
+		n := len(m.Cols)
+		return i*n - i*(i-1)/2 + (j - i)
+	}
+	return i*len(m.Cols) + j
+}
+
+// At returns the distance between the entry in row i and the entry in
+// column j.
+func (m *Matrix) At(i, j int) float64 {
+	if m.Symmetric && j < i {
+		i, j = j, i
+	}
+	return float64(m.Dists[m.index(i, j)])
+}
+
+// WriteTSV writes the matrix as tab separated values. The first line has
+// the Ids of every column, and each subsequent line starts with the Id of
+// its row. Symmetric matrices are written in full.
+func (m *Matrix) WriteTSV(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, id := range m.Cols {
+		buf.WriteByte('\t')
+		buf.WriteString(id)
+	}
+	buf.WriteByte('\n')
+	for i, id := range m.Rows {
+		buf.WriteString(id)
+		for j := range m.Cols {
+			buf.WriteByte('\t')
+			buf.WriteString(strconv.FormatFloat(m.At(i, j), 'f', 4, 32))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// WriteBinary writes the matrix in a compact binary format, which can be read
+// with ReadMatrix.
+//
+// All numbers are big endian. The format is the magic string "BOWMAT", a
+// version byte, a byte that is 1 for symmetric matrices and 0 otherwise,
+// the number of rows and columns as uint32s, the null terminated metric
+// name, the null terminated Ids of every row (and every column if the matrix
+// isn't symmetric) and finally every stored distance as a float32.
+func (m *Matrix) WriteBinary(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	buf.Write(matrixMagic)
+	buf.WriteByte(matrixVersion)
+	if m.Symmetric {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Rows)))
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Cols)))
+	buf.WriteString(m.Metric)
+	buf.WriteByte(0)
+
+	ids := m.Rows
+	if !m.Symmetric {
+		ids = append(append([]string{}, m.Rows...), m.Cols...)
+	}
+	for _, id := range ids {
+		buf.WriteString(id)
+		buf.WriteByte(0)
+	}
+
+	var num [4]byte
+	for _, d := range m.Dists {
+		binary.BigEndian.PutUint32(num[:], math.Float32bits(d))
+		if _, err := buf.Write(num[:]); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// ReadMatrix reads a distance matrix written by WriteBinary.
+func ReadMatrix(r io.Reader) (*Matrix, error) {
+	buf := bufio.NewReader(r)
+	header := make([]byte, len(matrixMagic)+2)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		return nil, fmt.Errorf("Could not read matrix header: %s", err)
+	}
+	if !bytes.Equal(header[:len(matrixMagic)], matrixMagic) {
+		return nil, fmt.Errorf("Not a BOW distance matrix.")
+	}
+	if v := header[len(matrixMagic)]; v != matrixVersion {
+		return nil, fmt.Errorf("Unsupported matrix version %d.", v)
+	}
+
+	m := &Matrix{Symmetric: header[len(matrixMagic)+1] == 1}
+	var nrows, ncols uint32
+	if err := binary.Read(buf, binary.BigEndian, &nrows); err != nil {
+		return nil, fmt.Errorf("Could not read number of rows: %s", err)
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ncols); err != nil {
+		return nil, fmt.Errorf("Could not read number of columns: %s", err)
+	}
+
+	if m.Symmetric && nrows != ncols {
+		return nil, fmt.Errorf("Symmetric matrix has %d rows but %d columns.",
+			nrows, ncols)
+	}
+
+	// Sizes are computed with int (not uint32) so that they can't overflow,
+	// and nothing is allocated up front based on the sizes in the header.
+	// Otherwise, a corrupt header could claim billions of distances.
+	readString := func() (string, error) {
+		s, err := buf.ReadString(0)
+		if err != nil {
+			return "", fmt.Errorf("Could not read matrix string: %s", err)
+		}
+		return s[:len(s)-1], nil
+	}
+	readIds := func(n int) ([]string, error) {
+		ids := make([]string, 0, min(n, matrixPrealloc))
+		for len(ids) < n {
+			id, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	var err error
+	if m.Metric, err = readString(); err != nil {
+		return nil, err
+	}
+	if m.Rows, err = readIds(int(nrows)); err != nil {
+		return nil, err
+	}
+	ndists := int(nrows) * int(ncols)
+	if m.Symmetric {
+		m.Cols = m.Rows
+		ndists = int(nrows) * (int(nrows) + 1) / 2
+	} else if m.Cols, err = readIds(int(ncols)); err != nil {
+		return nil, err
+	}
+
+	var num [4]byte
+	m.Dists = make([]float32, 0, min(ndists, matrixPrealloc))
+	for len(m.Dists) < ndists {
+		if _, err := io.ReadFull(buf, num[:]); err != nil {
+			return nil, fmt.Errorf("Could not read distance %d of %d: %s",
+				len(m.Dists), ndists, err)
+		}
+		d := math.Float32frombits(binary.BigEndian.Uint32(num[:]))
+		m.Dists = append(m.Dists, d)
+	}
+	if _, err := buf.Peek(1); err != io.EOF {
+		return nil, fmt.Errorf("The matrix has more than the %d distances "+
+			"given by its size (%d x %d).", ndists, nrows, ncols)
+	}
+	return m, nil
+}
+
+func entryIds(entries []Entry) []string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+	return ids
+}
@@ -0,0 +1,84 @@
+package bow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestMatrix(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	db := randomDB(rng, 150, 10)
+	other := randomDB(rng, 70, 10)
+
+	sym := db.Matrix(Cosine, WeightNone)
+	cross, err := db.MatrixWith(other, Manhattan, WeightNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		m          *Matrix
+		metric     Metric
+		rows, cols []Entry
+	}{
+		{sym, Cosine, db.Entries, db.Entries},
+		{cross, Manhattan, db.Entries, other.Entries},
+	} {
+		buf := new(bytes.Buffer)
+		if err := test.m.WriteBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadMatrix(buf)
+		if err != nil {
+			t.Fatalf("Could not read matrix: %s", err)
+		}
+
+		for i, row := range test.rows {
+			for j, col := range test.cols {
+				expected := float32(test.metric.Distance(row, col))
+				if got := float32(test.m.At(i, j)); got != expected {
+					t.Fatalf("(%d, %d): expected %f but got %f.",
+						i, j, expected, got)
+				}
+				if got := float32(read.At(i, j)); got != expected {
+					t.Fatalf("(%d, %d) after reading: expected %f but "+
+						"got %f.", i, j, expected, got)
+				}
+			}
+		}
+	}
+}
+
+func TestReadMatrixErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(18))
+	db := randomDB(rng, 20, 10)
+	buf := new(bytes.Buffer)
+	if err := db.Matrix(Cosine, WeightNone).WriteBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	// The number of rows and columns follow the magic string, the version
+	// and the symmetric flag.
+	sizes := len(matrixMagic) + 2
+	withSize := func(rows, cols uint32) []byte {
+		bs := append([]byte{}, good...)
+		binary.BigEndian.PutUint32(bs[sizes:], rows)
+		binary.BigEndian.PutUint32(bs[sizes+4:], cols)
+		return bs
+	}
+	for _, test := range []struct {
+		name string
+		bs   []byte
+	}{
+		{"truncated", good[:len(good)-3]},
+		{"trailing data", append(append([]byte{}, good...), 0, 0, 0, 0)},
+		{"rows and columns differ", withSize(20, 21)},
+		{"huge size", withSize(100000, 100000)},
+	} {
+		if _, err := ReadMatrix(bytes.NewReader(test.bs)); err == nil {
+			t.Fatalf("Reading a matrix with %s did not fail.", test.name)
+		}
+	}
+}
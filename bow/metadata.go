@@ -0,0 +1,287 @@
+package bow
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// The types of metadata fields.
+const (
+	FieldInt = iota
+	FieldFloat
+	FieldString
+)
+
+// Field describes a metadata field of the entries in a BOW database. Type is
+// one of FieldInt, FieldFloat or FieldString.
+type Field struct {
+	Name string
+	Type int
+}
+
+// Metadata is the values of the metadata fields of an entry, by field name.
+// Values of int fields are int64, values of float fields are float64 and
+// values of string fields are strings. An entry need not have a value for
+// every field.
+//
+// Metadata stored in a BOW database should not be modified.
+type Metadata map[string]interface{}
+
+// IntValue returns the value of the int field given.
+func (m Metadata) IntValue(name string) (int64, bool) {
+	v, ok := m[name].(int64)
+	return v, ok
+}
+
+// FloatValue returns the value of the float or int field given.
+func (m Metadata) FloatValue(name string) (float64, bool) {
+	switch v := m[name].(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// StringValue returns the value of the string field given.
+func (m Metadata) StringValue(name string) (string, bool) {
+	v, ok := m[name].(string)
+	return v, ok
+}
+
+// A MetadataBower is a StructureBower or SequenceBower with metadata to store
+// with its entry in a BOW database. Its metadata must only have values for
+// the fields of the database (see DB.Fields).
+type MetadataBower interface {
+	Metadata() Metadata
+}
+
+// normalizeValue converts a metadata value to the type used for the field
+// type given. Any integer type may be used for int fields, and any integer
+// or floating point type for float fields.
+func normalizeValue(typ int, v interface{}) (interface{}, bool) {
+	var i int64
+	var isInt bool
+	switch v := v.(type) {
+	case int:
+		i, isInt = int64(v), true
+	case int32:
+		i, isInt = int64(v), true
+	case int64:
+		i, isInt = v, true
+	case uint32:
+		i, isInt = int64(v), true
+	case float32:
+		if typ == FieldFloat {
+			return float64(v), true
+		}
+	case float64:
+		if typ == FieldFloat {
+			return v, true
+		}
+	case string:
+		if typ == FieldString {
+			return v, true
+		}
+	}
+	switch {
+	case isInt && typ == FieldInt:
+		return i, true
+	case isInt && typ == FieldFloat:
+		return float64(i), true
+	}
+	return nil, false
+}
+
+// checkMetadata returns a copy of the metadata given with its values
+// converted to the types of their fields, or an error if the metadata has
+// a field that isn't in db.Fields or a value of the wrong type.
+func (db *DB) checkMetadata(id string, meta Metadata) (Metadata, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	checked := make(Metadata, len(meta))
+	for name, v := range meta {
+		field, ok := db.field(name)
+		if !ok {
+			return nil, fmt.Errorf("The metadata of '%s' has a value for "+
+				"'%s', which is not a field of the BOW database '%s'.",
+				id, name, db)
+		}
+		if checked[name], ok = normalizeValue(field.Type, v); !ok {
+			return nil, fmt.Errorf("The metadata of '%s' has a value of "+
+				"type %T for '%s', which is the wrong type for the field.",
+				id, v, name)
+		}
+	}
+	return checked, nil
+}
+
+// queryMetadata returns the metadata of a value being searched for. Unlike
+// values being added, invalid metadata is not an error: values for unknown
+// fields are kept as is, and values of the wrong type are dropped.
+func (db *DB) queryMetadata(values Metadata) Metadata {
+	if values == nil {
+		return nil
+	}
+	meta := make(Metadata, len(values))
+	for name, v := range values {
+		field, ok := db.field(name)
+		if !ok {
+			meta[name] = v
+		} else if v, ok := normalizeValue(field.Type, v); ok {
+			meta[name] = v
+		}
+	}
+	return meta
+}
+
+// field returns the field with the name given.
+func (db *DB) field(name string) (Field, bool) {
+	for _, field := range db.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// SetMetadata sets the metadata of the entry with the given Id, replacing
+// any metadata it had. Metadata for Ids that are not in the database when it
+// is closed is discarded.
+//
+// When a value replaces an entry (see DuplicateReplace), the metadata of the
+// entry is not kept. The new entry only has the value's metadata, or the
+// metadata set with SetMetadata after the value was added.
+//
+// SetMetadata will panic if it is called on a BOW database that was opened
+// for reading.
+func (db *DB) SetMetadata(id string, meta Metadata) error {
+	if db.writing == nil {
+		panic("Cannot set metadata in a BOW database opened in read mode.")
+	}
+	meta, err := db.checkMetadata(id, meta)
+	if err != nil {
+		return err
+	}
+
+	db.seqLock.Lock()
+	seq := db.seq
+	db.seqLock.Unlock()
+
+	db.updateLock.Lock()
+	defer db.updateLock.Unlock()
+	db.setMetadata(id, meta)
+	if db.metaSeq == nil {
+		db.metaSeq = make(map[string]int)
+	}
+	db.metaSeq[id] = seq
+	for i := range db.Entries {
+		if db.Entries[i].Id == id {
+			db.Entries[i].Meta = meta
+		}
+	}
+	return nil
+}
+
+// setMetadata records the metadata of the entry with the given Id in a
+// database being written. db.updateLock must be held.
+func (db *DB) setMetadata(id string, meta Metadata) {
+	if db.meta == nil {
+		db.meta = make(map[string]Metadata)
+	}
+	if meta == nil {
+		delete(db.meta, id)
+		delete(db.metaSeq, id)
+	} else {
+		db.meta[id] = meta
+	}
+}
+
+// metaFile is the contents of 'bow.meta'. The metadata is sorted by Id, and
+// the values of each entry by name, so that building the same database
+// twice writes the same file.
+type metaFile struct {
+	Fields []Field
+	Values []metaEntry
+}
+
+// metaEntry is the metadata of a single entry in 'bow.meta'.
+type metaEntry struct {
+	Id     string
+	Values []metaValue
+}
+
+// metaValue is the value of a single metadata field in 'bow.meta'.
+type metaValue struct {
+	Name  string
+	Value interface{}
+}
+
+// readMetadata reads the metadata fields and values of the database, if it
+// has any.
+func (db *DB) readMetadata() error {
+	f, err := os.Open(db.filePath("bow.meta"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var mf metaFile
+	if err := gob.NewDecoder(f).Decode(&mf); err != nil {
+		return fmt.Errorf("Could not read metadata: %s", err)
+	}
+	db.Fields = mf.Fields
+	if len(mf.Values) > 0 {
+		db.meta = make(map[string]Metadata, len(mf.Values))
+	}
+	for _, e := range mf.Values {
+		meta := make(Metadata, len(e.Values))
+		for _, v := range e.Values {
+			meta[v.Name] = v.Value
+		}
+		db.meta[e.Id] = meta
+	}
+	return nil
+}
+
+// writeMetadata writes the metadata fields of a database being written and
+// the metadata of its entries. If there are neither, the file is removed.
+func (db *DB) writeMetadata() error {
+	mf := metaFile{Fields: db.Fields}
+	for id, meta := range db.meta {
+		if _, ok := db.ids[id]; !ok {
+			continue
+		}
+		e := metaEntry{id, make([]metaValue, 0, len(meta))}
+		for name, v := range meta {
+			e.Values = append(e.Values, metaValue{name, v})
+		}
+		sort.Slice(e.Values, func(i, j int) bool {
+			return e.Values[i].Name < e.Values[j].Name
+		})
+		mf.Values = append(mf.Values, e)
+	}
+	sort.Slice(mf.Values, func(i, j int) bool {
+		return mf.Values[i].Id < mf.Values[j].Id
+	})
+	if len(mf.Fields) == 0 && len(mf.Values) == 0 {
+		return db.removeFile("bow.meta")
+	}
+
+	f, err := db.createFile("bow.meta")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(mf); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write metadata: %s", err)
+	}
+	return closeFile(f)
+}
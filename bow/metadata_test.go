@@ -0,0 +1,309 @@
+package bow
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// metaChain is a chain with metadata.
+type metaChain struct {
+	chain
+	meta Metadata
+}
+
+func (c metaChain) Metadata() Metadata { return c.meta }
+
+var testFields = []Field{
+	{"length", FieldInt},
+	{"resolution", FieldFloat},
+	{"cath", FieldString},
+}
+
+// randomMetadata returns random metadata for the test fields, which may be
+// missing a resolution.
+func randomMetadata(rng *rand.Rand) Metadata {
+	meta := Metadata{
+		"length": int64(rng.Intn(300)),
+		"cath":   fmt.Sprintf("%d.%d", 1+rng.Intn(3), rng.Intn(3)),
+	}
+	if rng.Intn(4) > 0 {
+		meta["resolution"] = 1 + 3*rng.Float64()
+	}
+	return meta
+}
+
+// checkMetadata checks that the entries of the database have the metadata
+// given, by Id.
+func checkMetadata(t *testing.T, db *DB, expected map[string]Metadata) {
+	for _, entry := range db.Entries {
+		if fmt.Sprint(entry.Meta) != fmt.Sprint(expected[entry.Id]) {
+			t.Fatalf("Entry '%s' has metadata %v but expected %v.",
+				entry.Id, entry.Meta, expected[entry.Id])
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	rng := rand.New(rand.NewSource(13))
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := CreateDB(library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Fields = testFields
+
+	expected := make(map[string]Metadata)
+	for i := 0; i < 40; i++ {
+		c := metaChain{randomChain(rng, fmt.Sprintf("c%02d", i)), nil}
+		if i%10 != 0 {
+			c.meta = randomMetadata(rng)
+			expected[c.id] = c.meta
+		}
+		if err := db.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Untyped integers are converted, but other mismatches are errors.
+	c := metaChain{randomChain(rng, "int"), Metadata{"resolution": 2}}
+	if err := db.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	expected["int"] = Metadata{"resolution": 2.0}
+	for _, meta := range []Metadata{{"length": 1.5}, {"organism": "x"}} {
+		c := metaChain{randomChain(rng, "bad"), meta}
+		if err := db.Add(c); err == nil {
+			t.Fatalf("Adding metadata %v did not return an error.", meta)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Entries) != 41 {
+		t.Fatalf("Expected 41 entries but got %d.", len(db.Entries))
+	}
+	checkMetadata(t, db, expected)
+
+	// Metadata can be changed when updating a database, and is removed
+	// along with its entry.
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	db.Fields = append(db.Fields, Field{"organism", FieldString})
+	expected["c00"] = Metadata{"organism": "human"}
+	if err := db.SetMetadata("c00", expected["c00"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMetadata("c01", Metadata{"length": "long"}); err == nil {
+		t.Fatalf("Setting metadata of the wrong type did not fail.")
+	}
+	db.Delete("c02")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "c02")
+
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadata(t, db, expected)
+	if _, ok := db.meta["c02"]; ok {
+		t.Fatalf("The metadata of a deleted entry was kept.")
+	}
+
+	// Filtered searches of streaming databases are the same.
+	stream, err := OpenDBStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := stream.Get("c05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entry.Meta) != fmt.Sprint(expected["c05"]) {
+		t.Fatalf("Entry 'c05' has metadata %v but expected %v.",
+			entry.Meta, expected["c05"])
+	}
+	opts := SearchDefault
+	opts.Limit = -1
+	opts.Filters = []Filter{
+		FilterRange("length", 50, 250),
+		FilterDifferent("cath"),
+	}
+	got, err := stream.SearchStream(opts, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustSearch(t, db, opts, entry)
+	if len(got) != len(want) || len(want) == 0 {
+		t.Fatalf("Expected %d results but got %d.", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Id != want[i].Id {
+			t.Fatalf("Result %d is '%s' but expected '%s'.",
+				i, got[i].Id, want[i].Id)
+		}
+		length, _ := got[i].Meta.IntValue("length")
+		cath, _ := got[i].Meta.StringValue("cath")
+		if length < 50 || length > 250 || cath == entry.Meta["cath"] {
+			t.Fatalf("Result '%s' with metadata %v was not filtered.",
+				got[i].Id, got[i].Meta)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	rng := rand.New(rand.NewSource(14))
+	db := randomDB(rng, 2000, 8)
+	for i := range db.Entries {
+		db.Entries[i].Meta = randomMetadata(rng)
+	}
+	indexed := &DB{Lib: db.Lib, Entries: db.Entries}
+	indexed.Index = indexed.buildIndex(1)
+
+	filters := []Filter{
+		FilterRange("length", 100, 200),
+		FilterRange("resolution", 0, 2.5),
+		FilterEqual("cath", "2.1"),
+		FilterDifferent("cath"),
+	}
+	for trial := 0; trial < 50; trial++ {
+		query := db.Entries[rng.Intn(len(db.Entries))]
+		opts := SearchDefault
+		opts.Limit = rng.Intn(40) - 5
+		opts.SortBy = []Metric{Euclid, Cosine}[rng.Intn(2)]
+		for _, filter := range filters {
+			if rng.Intn(2) == 0 {
+				opts.Filters = append(opts.Filters, filter)
+			}
+		}
+
+		expected := fullSort(db, opts, query)
+		for _, got := range [][]SearchResult{
+			mustSearch(t, db, opts, query),
+			mustSearch(t, indexed, opts, query),
+		} {
+			if len(expected) != len(got) {
+				t.Fatalf("Trial %d: expected %d results but got %d.",
+					trial, len(expected), len(got))
+			}
+			for i := range expected {
+				if expected[i].Id != got[i].Id ||
+					expected[i].distance != got[i].Distance {
+					t.Fatalf("Trial %d: result %d is (%s, %f) but "+
+						"expected (%s, %f).", trial, i,
+						got[i].Id, got[i].Distance,
+						expected[i].Id, expected[i].distance)
+				}
+			}
+		}
+	}
+}
+
+func TestReplaceMetadata(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := CreateDB(library, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Fields = testFields
+	expected := make(map[string]Metadata)
+	for i := 0; i < 4; i++ {
+		c := metaChain{
+			randomChain(rng, fmt.Sprintf("c%02d", i)), randomMetadata(rng),
+		}
+		expected[c.id] = c.meta
+		if err := db.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replaced entry's metadata is not inherited by the value replacing
+	// it, unless it's set again after the value is added.
+	if db, err = OpenDBUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+	db.Duplicates = DuplicateReplace
+	if err := db.Add(randomChain(rng, "c00")); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "c00")
+	c := metaChain{randomChain(rng, "c01"), randomMetadata(rng)}
+	if err := db.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	expected["c01"] = c.meta
+	if err := db.Add(randomChain(rng, "c02")); err != nil {
+		t.Fatal(err)
+	}
+	expected["c02"] = randomMetadata(rng)
+	if err := db.SetMetadata("c02", expected["c02"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = OpenDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadata(t, db, expected)
+}
+
+func TestFilterEqual(t *testing.T) {
+	entry := Entry{Meta: Metadata{
+		"length":     int64(120),
+		"resolution": 2.0,
+		"cath":       "2.1",
+		"other":      []int{1},
+	}}
+	for _, c := range []struct {
+		field string
+		value interface{}
+		keep  bool
+	}{
+		{"length", 120, true},
+		{"length", 120.0, true},
+		{"length", int32(121), false},
+		{"resolution", int64(2), true},
+		{"resolution", float32(2.5), false},
+		{"cath", "2.1", true},
+		{"cath", "2.2", false},
+		{"missing", "2.1", false},
+		{"other", 1, false},
+	} {
+		if FilterEqual(c.field, c.value)(Entry{}, entry) != c.keep {
+			t.Fatalf("FilterEqual(%q, %v) did not return %v.",
+				c.field, c.value, c.keep)
+		}
+	}
+
+	// Values that can't be compared are rejected.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("FilterEqual accepted a slice.")
+			}
+		}()
+		FilterEqual("other", []int{1})
+	}()
+
+	// Metadata that can't be compared doesn't panic.
+	query := Entry{Meta: Metadata{"other": []int{1}}}
+	if !FilterDifferent("other")(query, entry) {
+		t.Fatalf("FilterDifferent did not keep an incomparable value.")
+	}
+}
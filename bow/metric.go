@@ -0,0 +1,246 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Metric is a distance function between the BOWs of two entries. Any value
+// implementing Metric can be used to sort search results with
+// SearchOptions.SortBy.
+//
+// Smaller distances always mean more similar BOWs.
+type Metric interface {
+	// Name returns a short lowercase name for the metric, e.g., "cosine".
+	Name() string
+
+	// Distance returns the distance between the BOWs of two entries.
+	// If either entry is weighted, the weighted BOWs should be compared.
+	Distance(e1, e2 Entry) float64
+}
+
+// The metrics provided by this package.
+var (
+	Euclid        Metric = euclid{}
+	Cosine        Metric = cosine{}
+	Manhattan     Metric = manhattan{}
+	Jaccard       Metric = jaccard{}
+	BrayCurtis    Metric = brayCurtis{}
+	JensenShannon Metric = jensenShannon{}
+)
+
+// Metrics is a list of all metrics provided by this package.
+var Metrics = []Metric{
+	Euclid, Cosine, Manhattan, Jaccard, BrayCurtis, JensenShannon,
+}
+
+// MetricByName returns the metric in Metrics with the given name.
+// Names are matched case insensitively.
+func MetricByName(name string) (Metric, error) {
+	for _, m := range Metrics {
+		if strings.EqualFold(m.Name(), name) {
+			return m, nil
+		}
+	}
+	names := make([]string, len(Metrics))
+	for i, m := range Metrics {
+		names[i] = m.Name()
+	}
+	return nil, fmt.Errorf("Unknown metric '%s'. Available metrics: %s.",
+		name, strings.Join(names, ", "))
+}
+
+type euclid struct{}
+
+func (euclid) Name() string                  { return "euclid" }
+func (euclid) Distance(e1, e2 Entry) float64 { return e1.Euclid(e2) }
+
+type cosine struct{}
+
+func (cosine) Name() string                  { return "cosine" }
+func (cosine) Distance(e1, e2 Entry) float64 { return e1.Cosine(e2) }
+
+type manhattan struct{}
+
+func (manhattan) Name() string { return "manhattan" }
+func (manhattan) Distance(e1, e2 Entry) float64 {
+	if e1.IsWeighted() || e2.IsWeighted() {
+		return e1.weighted().Manhattan(e2.weighted())
+	}
+	return e1.DenseBOW().Manhattan(e2.DenseBOW())
+}
+
+type jaccard struct{}
+
+func (jaccard) Name() string { return "jaccard" }
+func (jaccard) Distance(e1, e2 Entry) float64 {
+	if e1.IsWeighted() || e2.IsWeighted() {
+		return e1.weighted().Jaccard(e2.weighted())
+	}
+	return e1.DenseBOW().Jaccard(e2.DenseBOW())
+}
+
+type brayCurtis struct{}
+
+func (brayCurtis) Name() string { return "braycurtis" }
+func (brayCurtis) Distance(e1, e2 Entry) float64 {
+	if e1.IsWeighted() || e2.IsWeighted() {
+		return e1.weighted().BrayCurtis(e2.weighted())
+	}
+	return e1.DenseBOW().BrayCurtis(e2.DenseBOW())
+}
+
+type jensenShannon struct{}
+
+func (jensenShannon) Name() string { return "jensenshannon" }
+func (jensenShannon) Distance(e1, e2 Entry) float64 {
+	if e1.IsWeighted() || e2.IsWeighted() {
+		return e1.weighted().JensenShannon(e2.weighted())
+	}
+	return e1.DenseBOW().JensenShannon(e2.DenseBOW())
+}
+
+// Manhattan returns the manhattan (L1) distance between bow1 and bow2.
+func (bow1 BOW) Manhattan(bow2 BOW) float64 {
+	sum := 0.0
+	f1, f2 := bow1.Freqs, bow2.Freqs
+	for i := range f1 {
+		sum += math.Abs(float64(f1[i]) - float64(f2[i]))
+	}
+	return sum
+}
+
+// Jaccard returns the weighted Jaccard distance between bow1 and bow2,
+// which is one minus the ratio of the sum of the minimum frequencies to the
+// sum of the maximum frequencies. If both BOWs are empty, the distance
+// is 1.
+func (bow1 BOW) Jaccard(bow2 BOW) float64 {
+	var mins, maxs float64
+	f1, f2 := bow1.Freqs, bow2.Freqs
+	for i := range f1 {
+		if f1[i] < f2[i] {
+			mins += float64(f1[i])
+			maxs += float64(f2[i])
+		} else {
+			mins += float64(f2[i])
+			maxs += float64(f1[i])
+		}
+	}
+	if maxs == 0 {
+		return 1.0
+	}
+	return 1.0 - mins/maxs
+}
+
+// BrayCurtis returns the Bray-Curtis dissimilarity between bow1 and bow2,
+// which is the sum of the absolute differences of frequencies divided by the
+// sum of all frequencies. If both BOWs are empty, the distance is 1.
+func (bow1 BOW) BrayCurtis(bow2 BOW) float64 {
+	var diffs, sums float64
+	f1, f2 := bow1.Freqs, bow2.Freqs
+	for i := range f1 {
+		diffs += math.Abs(float64(f1[i]) - float64(f2[i]))
+		sums += float64(f1[i]) + float64(f2[i])
+	}
+	if sums == 0 {
+		return 1.0
+	}
+	return diffs / sums
+}
+
+// JensenShannon returns the Jensen-Shannon divergence (with base 2
+// logarithms) between bow1 and bow2 after normalizing each to a probability
+// distribution. The divergence is always in the range [0, 1]. If either BOW
+// is empty, the distance is 1.
+func (bow1 BOW) JensenShannon(bow2 BOW) float64 {
+	var sum1, sum2 float64
+	f1, f2 := bow1.Freqs, bow2.Freqs
+	for i := range f1 {
+		sum1 += float64(f1[i])
+		sum2 += float64(f2[i])
+	}
+	if sum1 == 0 || sum2 == 0 {
+		return 1.0
+	}
+
+	div := 0.0
+	for i := range f1 {
+		div += jsTerm(float64(f1[i])/sum1, float64(f2[i])/sum2)
+	}
+	return div
+}
+
+// Manhattan returns the manhattan (L1) distance between bow1 and bow2.
+func (bow1 WeightedBOW) Manhattan(bow2 WeightedBOW) float64 {
+	sum := 0.0
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		sum += math.Abs(w1[i] - w2[i])
+	}
+	return sum
+}
+
+// Jaccard returns the weighted Jaccard distance between bow1 and bow2.
+// See (BOW).Jaccard.
+func (bow1 WeightedBOW) Jaccard(bow2 WeightedBOW) float64 {
+	var mins, maxs float64
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		mins += math.Min(w1[i], w2[i])
+		maxs += math.Max(w1[i], w2[i])
+	}
+	if maxs == 0 {
+		return 1.0
+	}
+	return 1.0 - mins/maxs
+}
+
+// BrayCurtis returns the Bray-Curtis dissimilarity between bow1 and bow2.
+// See (BOW).BrayCurtis.
+func (bow1 WeightedBOW) BrayCurtis(bow2 WeightedBOW) float64 {
+	var diffs, sums float64
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		diffs += math.Abs(w1[i] - w2[i])
+		sums += w1[i] + w2[i]
+	}
+	if sums == 0 {
+		return 1.0
+	}
+	return diffs / sums
+}
+
+// JensenShannon returns the Jensen-Shannon divergence between bow1 and bow2.
+// See (BOW).JensenShannon.
+func (bow1 WeightedBOW) JensenShannon(bow2 WeightedBOW) float64 {
+	var sum1, sum2 float64
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		sum1 += w1[i]
+		sum2 += w2[i]
+	}
+	if sum1 == 0 || sum2 == 0 {
+		return 1.0
+	}
+
+	div := 0.0
+	for i := range w1 {
+		div += jsTerm(w1[i]/sum1, w2[i]/sum2)
+	}
+	return div
+}
+
+// jsTerm returns the contribution of a single fragment with probabilities
+// p and q to the Jensen-Shannon divergence.
+func jsTerm(p, q float64) float64 {
+	m := (p + q) / 2
+	term := 0.0
+	if p > 0 {
+		term += 0.5 * p * math.Log2(p/m)
+	}
+	if q > 0 {
+		term += 0.5 * q * math.Log2(q/m)
+	}
+	return term
+}
@@ -10,7 +10,7 @@ import (
 var (
 	libpath = "../data/fraglibs/centers400_11.brk"
 
-	library  *fragbag.Library
+	library  *fragbag.StructureLibrary
 	oldstyle []string
 	newstyle []BOW
 )
@@ -25,7 +25,7 @@ func newBowMap(size int, mfreqs map[int]uint32) BOW {
 
 func init() {
 	var err error
-	library, err = fragbag.NewLibrary(libpath)
+	library, err = fragbag.OpenBrkFile(libpath)
 	if err != nil {
 		panic(fmt.Sprintf("Could not initialize fragment library at path "+
 			"'%s' because: %s.", libpath, err))
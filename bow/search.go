@@ -1,13 +1,11 @@
 package bow
 
 import (
-	"fmt"
 	"math"
-)
+	"runtime"
+	"sync"
 
-const (
-	Euclid = iota
-	Cosine
+	"github.com/BurntSushi/bcbgo/fragbag"
 )
 
 const (
@@ -15,114 +13,260 @@ const (
 	OrderDesc
 )
 
+// SearchOptions controls how a search is performed. Weighting is one of
+// WeightNone, WeightTFIDF or WeightBM25, and is applied to both the query
+// and every entry before distances are computed.
+//
+// Budget only matters for databases with an index. When it is in the range
+// (0, 1), searches that use the index are approximate and compute distances
+// for at most Budget * N entries, where N is the number of entries in the
+// database. Otherwise, searches are exact. Budget is not the recall of a
+// search, which depends on the database. (Use MeasureRecall to find it, or
+// the index-recall experiment for a database of SABmark chains.)
+//
+// Filters are applied to every entry before its distance is computed, and
+// only entries kept by every filter can be results.
 type SearchOptions struct {
-	Limit  int
-	Min    float64
-	Max    float64
-	SortBy int
-	Order  int
+	Limit     int
+	Min       float64
+	Max       float64
+	SortBy    Metric
+	Order     int
+	Weighting int
+	Budget    float64
+	Filters   []Filter
 }
 
 var SearchDefault = SearchOptions{
-	Limit:  25,
-	Min:    0.0,
-	Max:    math.MaxFloat64,
-	SortBy: Cosine,
-	Order:  OrderAsc,
+	Limit:     25,
+	Min:       0.0,
+	Max:       math.MaxFloat64,
+	SortBy:    Cosine,
+	Order:     OrderAsc,
+	Weighting: WeightNone,
 }
 
 var SearchClose = SearchOptions{
-	Limit:  -1,
-	Min:    0.0,
-	Max:    0.35,
-	SortBy: Cosine,
-	Order:  OrderAsc,
+	Limit:     -1,
+	Min:       0.0,
+	Max:       0.35,
+	SortBy:    Cosine,
+	Order:     OrderAsc,
+	Weighting: WeightNone,
 }
 
+// SearchResult is a single entry returned by a search. Distance is the
+// distance between the query and the entry according to Metric, which is the
+// metric used to sort the search results. The cosine and euclidean distances
+// are always included for convenience.
+//
+// All distances are computed after applying the weighting scheme used in the
+// search, but the entry itself is never weighted.
 type SearchResult struct {
 	Entry
+	Metric         Metric
+	Distance       float64
 	Cosine, Euclid float64
 }
 
-func newSearchResult(query, entry Entry) SearchResult {
+// keep returns true if the entry is kept by every filter in the options.
+func (opts SearchOptions) keep(query, entry Entry) bool {
+	for _, filter := range opts.Filters {
+		if !filter(query, entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// newSearchResult creates a search result for an entry, where wquery and
+// wentry are the query and entry with weighting applied.
+func newSearchResult(
+	entry, wquery, wentry Entry,
+	metric Metric,
+	dist float64,
+) SearchResult {
 	return SearchResult{
-		Entry:  entry,
-		Cosine: query.BOW.Cosine(entry.BOW),
-		Euclid: query.BOW.Euclid(entry.BOW),
+		Entry:    entry,
+		Metric:   metric,
+		Distance: dist,
+		Cosine:   wquery.Cosine(wentry),
+		Euclid:   wquery.Euclid(wentry),
 	}
 }
 
-func (db *DB) Search(opts SearchOptions, bower StructureBower) []SearchResult {
-	query := Entry{
-		Id:  bower.Id(),
-		BOW: StructureBOW(db.Lib, bower),
+// Search computes the BOW of the given value with the database's structure
+// fragment library and searches the database for its neighbors. (See Query
+// and SearchEntry.)
+//
+// Search will panic if the database uses a sequence fragment library.
+func (db *DB) Search(
+	opts SearchOptions,
+	bower StructureBower,
+) ([]SearchResult, error) {
+	return db.SearchEntry(opts, db.Query(bower))
+}
+
+// SearchSequence is just like Search, except the BOW of the given value is
+// computed with the database's sequence fragment library.
+//
+// SearchSequence will panic if the database uses a structure fragment
+// library.
+func (db *DB) SearchSequence(
+	opts SearchOptions,
+	bower SequenceBower,
+) ([]SearchResult, error) {
+	return db.SearchEntry(opts, db.QuerySequence(bower))
+}
+
+// Query computes the entry used to search the database for the given value,
+// with the database's structure fragment library (and soft assignment
+// options). If the value implements MetadataBower, its metadata is used by
+// the search filters. Query is useful with SearchEntry.
+//
+// Query will panic if the database uses a sequence fragment library.
+func (db *DB) Query(bower StructureBower) Entry {
+	if _, ok := db.Lib.(*fragbag.StructureLibrary); !ok {
+		panic("Cannot search a BOW database with a sequence fragment " +
+			"library using a StructureBower.")
 	}
-	return db.SearchEntry(opts, query)
+	return db.queryEntry(bowJob{structure: bower})
 }
 
-func (db *DB) SearchEntry(opts SearchOptions, query Entry) []SearchResult {
-	tree := new(bst)
+// QuerySequence is just like Query, except the BOW of the given value is
+// computed with the database's sequence fragment library.
+//
+// QuerySequence will panic if the database uses a structure fragment
+// library.
+func (db *DB) QuerySequence(bower SequenceBower) Entry {
+	if _, ok := db.Lib.(*fragbag.SequenceLibrary); !ok {
+		panic("Cannot search a BOW database with a structure fragment " +
+			"library using a SequenceBower.")
+	}
+	return db.queryEntry(bowJob{sequence: bower})
+}
 
-	for _, entry := range db.Entries {
-		// Compute the distance between the query and the target.
-		var dist float64
-		switch opts.SortBy {
-		case Cosine:
-			dist = query.BOW.Cosine(entry.BOW)
-		case Euclid:
-			dist = query.BOW.Euclid(entry.BOW)
-		default:
-			panic(fmt.Sprintf("Unrecognized SortBy value: %d", opts.SortBy))
-		}
+// queryEntry computes the entry for a value being searched for.
+func (db *DB) queryEntry(job bowJob) Entry {
+	entry := db.computeEntry(job)
+	entry.Meta = db.queryMetadata(job.metadata())
+	return entry
+}
 
-		// If the distance isn't in the min/max thresholds specified, skip it.
-		if dist > opts.Max || dist < opts.Min {
-			continue
-		}
+// searchParallelMin is the minimum number of entries in a database before
+// a search is split across multiple goroutines. Below this, the overhead
+// of starting goroutines isn't worth it.
+var searchParallelMin = 1000
 
-		// If there is a limit and we're already at that limit, then
-		// we'll skip inserting this element if it's not better than the
-		// worst hit.
-		if tree.size == opts.Limit {
-			if opts.Order == OrderAsc && dist >= tree.max.distance {
-				continue
-			} else if opts.Order == OrderDesc && dist <= tree.min.distance {
-				continue
-			}
-		}
+// SearchEntry searches the database for the neighbors of the query entry.
+// At most opts.Limit results are returned (or all of them if the limit is
+// negative), sorted by the distance given by opts.SortBy in the order given
+// by opts.Order. Results with equal distances are sorted by Id.
+//
+// The entries in the database are partitioned across GOMAXPROCS goroutines,
+// where each keeps its own best results. The results are then merged, so
+// that they are always identical to a search on a single goroutine.
+//
+// If the database was opened with OpenDBStream, its entries are read from
+// disk as they are searched (see SearchStream), and any error encountered
+// while reading them is returned. Otherwise, the error is always nil.
+func (db *DB) SearchEntry(
+	opts SearchOptions,
+	query Entry,
+) ([]SearchResult, error) {
+	if db.stream {
+		return db.SearchStream(opts, query)
+	}
+	if opts.SortBy == nil {
+		panic("No metric given in SortBy.")
+	}
+	if db.updating {
+		db.updateLock.Lock()
+		defer db.updateLock.Unlock()
+	}
 
-		// This target is good enough, add it to our results.
-		tree.insert(entry, dist)
-
-		// This element is good enough, so lets throw away the worst
-		// result we have.
-		if opts.Limit >= 0 && tree.size == opts.Limit+1 {
-			if opts.Order == OrderAsc {
-				tree.deleteMax()
-			} else {
-				tree.deleteMin()
-			}
-		}
+	if results, ok := db.searchIndex(opts, query); ok {
+		return results, nil
+	}
 
-		// Sanity check.
-		if opts.Limit >= 0 && tree.size > opts.Limit {
-			panic(fmt.Sprintf("Tree size (%d) is bigger than limit (%d).",
-				tree.size, opts.Limit))
-		}
+	// Apply the weighting scheme to the query and all entries. When there
+	// is no weighting, these are the query and entries unchanged.
+	wquery := db.DocFreqs.Weigh(opts.Weighting, query)
+	wentries := db.weightedEntries(opts.Weighting)
+
+	workers := max(1, runtime.GOMAXPROCS(0))
+	if len(db.Entries) < searchParallelMin {
+		workers = 1
 	}
+	return db.searchEntry(opts, wquery, wentries, workers), nil
+}
 
-	results := make([]SearchResult, tree.size)
-	i := 0
-	if opts.Order == OrderAsc {
-		tree.root.inorder(func(n *node) {
-			results[i] = newSearchResult(query, n.Entry)
-			i += 1
-		})
-	} else {
-		tree.root.inorderReverse(func(n *node) {
-			results[i] = newSearchResult(query, n.Entry)
-			i += 1
-		})
+// searchEntry searches the database with the weighted query and entries
+// given using the number of goroutines given.
+func (db *DB) searchEntry(
+	opts SearchOptions,
+	wquery Entry,
+	wentries []Entry,
+	workers int,
+) []SearchResult {
+	bests := make([]*topk, workers)
+	chunk := (len(db.Entries) + workers - 1) / workers
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		start := min(len(db.Entries), w*chunk)
+		end := min(len(db.Entries), start+chunk)
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			bests[w] = db.searchRange(opts, wquery, wentries, start, end)
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	best := bests[0]
+	for _, other := range bests[1:] {
+		best.merge(other)
+	}
+	return db.results(opts, wquery, wentries, best.sorted())
+}
+
+// results converts the hits of a search to search results.
+func (db *DB) results(
+	opts SearchOptions,
+	wquery Entry,
+	wentries []Entry,
+	hits []hit,
+) []SearchResult {
+	results := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		results[i] = newSearchResult(h.Entry, wquery, wentries[h.index],
+			opts.SortBy, h.distance)
 	}
 	return results
 }
+
+// searchRange returns the best hits for the query among the entries in the
+// range [start, end).
+func (db *DB) searchRange(
+	opts SearchOptions,
+	wquery Entry,
+	wentries []Entry,
+	start, end int,
+) *topk {
+	best := newTopK(opts.Limit, opts.Order)
+	for i := start; i < end; i++ {
+		if !opts.keep(wquery, db.Entries[i]) {
+			continue
+		}
+
+		// Compute the distance between the query and the target.
+		dist := opts.SortBy.Distance(wquery, wentries[i])
+
+		// If the distance isn't in the min/max thresholds specified, skip it.
+		if dist > opts.Max || dist < opts.Min {
+			continue
+		}
+		best.add(hit{db.Entries[i], dist, i})
+	}
+	return best
+}
@@ -0,0 +1,145 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/BurntSushi/bcbgo/fragbag"
+	"github.com/TuftsBCB/structure"
+)
+
+// randomDB returns a database in memory with n random entries. Frequencies
+// are small so that there are plenty of ties in distances.
+func randomDB(rng *rand.Rand, n, libs int) *DB {
+	lib := fragbag.NewStructureLibrary("random")
+	for i := 0; i < libs; i++ {
+		lib.Add([]structure.Coords{{X: float64(i)}})
+	}
+
+	db := &DB{Lib: lib, Entries: make([]Entry, n)}
+	for i := range db.Entries {
+		b := NewBow(libs)
+		for j := range b.Freqs {
+			b.Freqs[j] = uint32(rng.Intn(3))
+		}
+		db.Entries[i] = Entry{Id: fmt.Sprintf("%04d", rng.Intn(n)), BOW: b}
+	}
+	return db
+}
+
+// fullSort computes search results by sorting every entry.
+func fullSort(db *DB, opts SearchOptions, query Entry) []hit {
+	hits := make([]hit, 0, len(db.Entries))
+	for i, entry := range db.Entries {
+		if !opts.keep(query, entry) {
+			continue
+		}
+		dist := opts.SortBy.Distance(query, entry)
+		if dist > opts.Max || dist < opts.Min {
+			continue
+		}
+		hits = append(hits, hit{entry, dist, i})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		h1, h2 := hits[i], hits[j]
+		if h1.distance != h2.distance {
+			if opts.Order == OrderDesc {
+				return h1.distance > h2.distance
+			}
+			return h1.distance < h2.distance
+		}
+		return h1.Id < h2.Id
+	})
+	if opts.Limit >= 0 && len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+	}
+	return hits
+}
+
+func TestSearchTopK(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 200; trial++ {
+		db := randomDB(rng, 1+rng.Intn(300), 1+rng.Intn(8))
+		query := db.Entries[rng.Intn(len(db.Entries))]
+
+		opts := SearchDefault
+		opts.Limit = rng.Intn(40) - 5
+		opts.Order = []int{OrderAsc, OrderDesc}[rng.Intn(2)]
+		opts.SortBy = Metrics[rng.Intn(len(Metrics))]
+		if rng.Intn(3) == 0 {
+			opts.Max = 0.5
+		}
+
+		expected := fullSort(db, opts, query)
+		got := mustSearch(t, db, opts, query)
+		if len(expected) != len(got) {
+			t.Fatalf("Trial %d: expected %d results but got %d.",
+				trial, len(expected), len(got))
+		}
+		for i := range expected {
+			if expected[i].Id != got[i].Id ||
+				expected[i].distance != got[i].Distance {
+				t.Fatalf("Trial %d (order %d, limit %d): result %d is "+
+					"(%s, %f) but expected (%s, %f).",
+					trial, opts.Order, opts.Limit, i,
+					got[i].Id, got[i].Distance,
+					expected[i].Id, expected[i].distance)
+			}
+		}
+	}
+}
+
+func TestSearchHugeLimit(t *testing.T) {
+	rng := rand.New(rand.NewSource(17))
+	db := randomDB(rng, 50, 5)
+	opts := SearchDefault
+	opts.Limit = math.MaxInt
+	if got := mustSearch(t, db, opts, db.Entries[0]); len(got) != 50 {
+		t.Fatalf("Expected 50 results but got %d.", len(got))
+	}
+}
+
+// mustSearch searches the database for the query, and fails the test if
+// there is an error.
+func mustSearch(
+	t *testing.T,
+	db *DB,
+	opts SearchOptions,
+	query Entry,
+) []SearchResult {
+	results, err := db.SearchEntry(opts, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestSearchParallel(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for trial := 0; trial < 50; trial++ {
+		db := randomDB(rng, 1+rng.Intn(2000), 1+rng.Intn(8))
+		query := db.Entries[rng.Intn(len(db.Entries))]
+
+		opts := SearchDefault
+		opts.Limit = rng.Intn(40) - 5
+		opts.Order = []int{OrderAsc, OrderDesc}[rng.Intn(2)]
+		opts.SortBy = Metrics[rng.Intn(len(Metrics))]
+
+		seq := db.searchEntry(opts, query, db.Entries, 1)
+		par := db.searchEntry(opts, query, db.Entries, 1+rng.Intn(16))
+		if len(seq) != len(par) {
+			t.Fatalf("Trial %d: sequential search found %d results but "+
+				"parallel search found %d.", trial, len(seq), len(par))
+		}
+		for i := range seq {
+			if seq[i].Id != par[i].Id || seq[i].Distance != par[i].Distance {
+				t.Fatalf("Trial %d: result %d is (%s, %f) sequentially but "+
+					"(%s, %f) in parallel.", trial, i,
+					seq[i].Id, seq[i].Distance, par[i].Id, par[i].Distance)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/BurntSushi/bcbgo/fragbag"
+)
+
+// SoftOptions controls soft assignment of fragments. With soft assignment,
+// each window of atoms spreads a single vote across the K fragments with the
+// lowest RMSD, instead of voting only for the best one. This makes BOWs
+// less sensitive to small changes in coordinates that flip the best
+// fragment.
+//
+// The weight of each of the K fragments is computed with a Gaussian kernel
+// on its RMSD relative to the best fragment:
+//
+//	exp(-(rmsd^2 - bestRmsd^2) / (2 * Sigma^2))
+//
+// The weights are then normalized so that each window contributes a total
+// weight of 1.
+type SoftOptions struct {
+	K     int
+	Sigma float64
+}
+
+var SoftDefault = SoftOptions{
+	K:     3,
+	Sigma: 0.5,
+}
+
+func (opts SoftOptions) String() string {
+	return fmt.Sprintf("k=%d, sigma=%0.4f", opts.K, opts.Sigma)
+}
+
+// validate returns an error if the options cannot be used for soft
+// assignment.
+func (opts SoftOptions) validate() error {
+	if opts.K < 1 {
+		return fmt.Errorf("Soft assignment requires K >= 1, but K = %d.",
+			opts.K)
+	}
+	if opts.Sigma <= 0 {
+		return fmt.Errorf("Soft assignment requires Sigma > 0, but "+
+			"Sigma = %f.", opts.Sigma)
+	}
+	return nil
+}
+
+// StructureSoftBOW computes a weighted bag-of-words vector for the given value
+// using a structure fragment library and soft assignment. Windows are the
+// same as in StructureBOW. An error is returned if the options are invalid.
+func StructureSoftBOW(
+	lib *fragbag.StructureLibrary,
+	bower StructureBower,
+	opts SoftOptions,
+) (WeightedBOW, error) {
+	if err := opts.validate(); err != nil {
+		return WeightedBOW{}, err
+	}
+	return structureSoftBOW(lib, bower, opts), nil
+}
+
+// structureSoftBOW is StructureSoftBOW with options that have already been
+// validated.
+func structureSoftBOW(
+	lib *fragbag.StructureLibrary,
+	bower StructureBower,
+	opts SoftOptions,
+) WeightedBOW {
+	var uplimit int
+
+	b := NewWeightedBow(lib.Size())
+	libSize := lib.FragmentSize
+	weights := make([]float64, opts.K)
+	twoSigmaSq := 2 * opts.Sigma * opts.Sigma
+	for _, chunk := range bower.Atoms() {
+		if len(chunk) < libSize {
+			continue
+		}
+		uplimit = len(chunk) - libSize
+		for i := 0; i <= uplimit; i++ {
+			nums, rmsds := lib.BestK(chunk[i:i+libSize], opts.K)
+			if len(nums) == 0 {
+				continue
+			}
+			bestSq := rmsds[0] * rmsds[0]
+
+			total := 0.0
+			for j, rmsd := range rmsds {
+				weights[j] = math.Exp(-(rmsd*rmsd - bestSq) / twoSigmaSq)
+				total += weights[j]
+			}
+			for j, fragNum := range nums {
+				b.Weights[fragNum] += weights[j] / total
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,97 @@
+package bow
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSoftDB(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	chains := make([]chain, 20)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+
+	dir := tempDBPath(t)
+	defer os.RemoveAll(path.Dir(dir))
+	db, err := CreateSoftDB(library, dir, SoftDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chains {
+		if err := db.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Weights are stored as 32 bit floats.
+	check := func(entry Entry, c chain) {
+		expected, err := StructureSoftBOW(library, c, SoftDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Id != c.id || !entry.IsWeighted() {
+			t.Fatalf("Entry '%s' is not a weighted entry for '%s'.",
+				entry.Id, c.id)
+		}
+		for i, w := range expected.Weights {
+			if float32(w) != float32(entry.Weighted.Weights[i]) {
+				t.Fatalf("Entry '%s' has weight %f for fragment %d but "+
+					"expected %f.", c.id, entry.Weighted.Weights[i], i, w)
+			}
+		}
+	}
+
+	loaded, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Soft == nil || *loaded.Soft != SoftDefault {
+		t.Fatalf("Expected soft assignment options %s but got %v.",
+			SoftDefault, loaded.Soft)
+	}
+	if len(loaded.Entries) != len(chains) {
+		t.Fatalf("Expected %d entries but got %d.",
+			len(chains), len(loaded.Entries))
+	}
+	stream, err := OpenDBStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []*DB{loaded, stream} {
+		for _, c := range chains {
+			entry, err := db.Get(c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(entry, c)
+		}
+	}
+
+	// A search for a chain in the database finds itself first.
+	opts := SearchDefault
+	opts.Limit = 3
+	results, err := loaded.Search(opts, chains[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].Id != chains[4].id {
+		t.Fatalf("Expected '%s' as the first result but got %v.",
+			chains[4].id, results)
+	}
+}
+
+func TestSoftInvalid(t *testing.T) {
+	c := randomChain(rand.New(rand.NewSource(16)), "c")
+	for _, opts := range []SoftOptions{{K: -1, Sigma: 0.5}, {K: 3}} {
+		if _, err := StructureSoftBOW(library, c, opts); err == nil {
+			t.Fatalf("Soft assignment with options %s did not fail.", opts)
+		}
+	}
+}
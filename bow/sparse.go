@@ -0,0 +1,237 @@
+package bow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SparseBOW is a bag-of-words vector that only stores the fragments with a
+// non-zero frequency. Most BOWs computed with large fragment libraries are
+// sparse, in which case a SparseBOW uses less memory than a BOW, and
+// distances between SparseBOWs are faster to compute.
+//
+// Entries read from a BOW database have a sparse BOW instead of a BOW when
+// the sparse BOW is smaller.
+type SparseBOW struct {
+	// Size is the number of fragments in the corresponding fragment library.
+	Size int
+
+	// Indices are the fragment numbers with non-zero frequencies in
+	// increasing order, and Freqs are their corresponding frequencies.
+	Indices []uint32
+	Freqs   []uint32
+}
+
+// Sparse returns the sparse representation of the BOW.
+func (bow BOW) Sparse() SparseBOW {
+	nnz := 0
+	for _, f := range bow.Freqs {
+		if f > 0 {
+			nnz++
+		}
+	}
+	sparse := SparseBOW{
+		Size:    bow.Len(),
+		Indices: make([]uint32, 0, nnz),
+		Freqs:   make([]uint32, 0, nnz),
+	}
+	for i, f := range bow.Freqs {
+		if f > 0 {
+			sparse.Indices = append(sparse.Indices, uint32(i))
+			sparse.Freqs = append(sparse.Freqs, f)
+		}
+	}
+	return sparse
+}
+
+// BOW returns the dense representation of the sparse BOW.
+func (bow SparseBOW) BOW() BOW {
+	dense := NewBow(bow.Size)
+	for k, i := range bow.Indices {
+		dense.Freqs[i] = bow.Freqs[k]
+	}
+	return dense
+}
+
+// Len returns the size of the vector. This is always equivalent to the
+// corresponding library's fragment size.
+func (bow SparseBOW) Len() int {
+	return bow.Size
+}
+
+// Dot returns the dot product of bow1 and bow2.
+func (bow1 SparseBOW) Dot(bow2 SparseBOW) float64 {
+	dot := 0.0
+	i1, i2 := bow1.Indices, bow2.Indices
+	for a, b := 0, 0; a < len(i1) && b < len(i2); {
+		switch {
+		case i1[a] < i2[b]:
+			a++
+		case i1[a] > i2[b]:
+			b++
+		default:
+			dot += float64(bow1.Freqs[a]) * float64(bow2.Freqs[b])
+			a++
+			b++
+		}
+	}
+	return dot
+}
+
+// Magnitude returns the vector length of the bow.
+func (bow SparseBOW) Magnitude() float64 {
+	return math.Sqrt(bow.squareSum())
+}
+
+func (bow SparseBOW) squareSum() float64 {
+	mag := 0.0
+	for _, f := range bow.Freqs {
+		mag += float64(f) * float64(f)
+	}
+	return mag
+}
+
+// Cosine returns the cosine distance between bow1 and bow2.
+func (bow1 SparseBOW) Cosine(bow2 SparseBOW) float64 {
+	r := 1.0 - (bow1.Dot(bow2) / math.Sqrt(bow1.squareSum()*bow2.squareSum()))
+	if math.IsNaN(r) {
+		return 1.0
+	}
+	return r
+}
+
+// Euclid returns the euclidean distance between bow1 and bow2.
+func (bow1 SparseBOW) Euclid(bow2 SparseBOW) float64 {
+	// |a - b|^2 = |a|^2 + |b|^2 - 2 a.b isn't exact for large frequencies,
+	// so walk both vectors instead.
+	squareSum := 0.0
+	i1, i2 := bow1.Indices, bow2.Indices
+	var d float64
+	a, b := 0, 0
+	for a < len(i1) || b < len(i2) {
+		switch {
+		case b == len(i2) || (a < len(i1) && i1[a] < i2[b]):
+			d = float64(bow1.Freqs[a])
+			a++
+		case a == len(i1) || i1[a] > i2[b]:
+			d = float64(bow2.Freqs[b])
+			b++
+		default:
+			d = float64(bow1.Freqs[a]) - float64(bow2.Freqs[b])
+			a++
+			b++
+		}
+		squareSum += d * d
+	}
+	return math.Sqrt(squareSum)
+}
+
+// DotBOW returns the dot product of a sparse BOW and a BOW.
+func (bow1 SparseBOW) DotBOW(bow2 BOW) float64 {
+	dot := 0.0
+	for k, i := range bow1.Indices {
+		dot += float64(bow1.Freqs[k]) * float64(bow2.Freqs[i])
+	}
+	return dot
+}
+
+// CosineBOW returns the cosine distance between a sparse BOW and a BOW.
+func (bow1 SparseBOW) CosineBOW(bow2 BOW) float64 {
+	mag2 := 0.0
+	for _, f := range bow2.Freqs {
+		mag2 += float64(f) * float64(f)
+	}
+	r := 1.0 - (bow1.DotBOW(bow2) / math.Sqrt(bow1.squareSum()*mag2))
+	if math.IsNaN(r) {
+		return 1.0
+	}
+	return r
+}
+
+// EuclidBOW returns the euclidean distance between a sparse BOW and a BOW.
+func (bow1 SparseBOW) EuclidBOW(bow2 BOW) float64 {
+	squareSum := 0.0
+	next := 0
+	var d float64
+	for i, f2 := range bow2.Freqs {
+		d = float64(f2)
+		if next < len(bow1.Indices) && bow1.Indices[next] == uint32(i) {
+			d -= float64(bow1.Freqs[next])
+			next++
+		}
+		squareSum += d * d
+	}
+	return math.Sqrt(squareSum)
+}
+
+// String returns a string representation of the sparse BOW, which is
+// identical to the string representation of the corresponding BOW.
+func (bow SparseBOW) String() string {
+	pieces := make([]string, len(bow.Indices))
+	for k, i := range bow.Indices {
+		pieces[k] = fmt.Sprintf("%d: %d", i, bow.Freqs[k])
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pieces, ", "))
+}
+
+// encode returns the on disk encoding of the sparse BOW: the number of
+// non-zero frequencies followed by each fragment number (as the difference
+// from the previous fragment number) and its frequency, all as uvarints.
+func (bow SparseBOW) encode() []byte {
+	buf := make([]byte, 0, (1+2*len(bow.Indices))*binary.MaxVarintLen32)
+	var num [binary.MaxVarintLen64]byte
+	put := func(x uint32) {
+		n := binary.PutUvarint(num[:], uint64(x))
+		buf = append(buf, num[:n]...)
+	}
+
+	put(uint32(len(bow.Indices)))
+	last := uint32(0)
+	for k, i := range bow.Indices {
+		put(i - last)
+		put(bow.Freqs[k])
+		last = i
+	}
+	return buf
+}
+
+// decodeSparse decodes a sparse BOW written by encode for a fragment library
+// with the given size.
+func decodeSparse(b []byte, size int) (SparseBOW, error) {
+	bad := fmt.Errorf("Invalid sparse BOW for a fragment library of size %d.",
+		size)
+	get := func() (uint32, bool) {
+		x, n := binary.Uvarint(b)
+		if n <= 0 || x > math.MaxUint32 {
+			return 0, false
+		}
+		b = b[n:]
+		return uint32(x), true
+	}
+
+	nnz, ok := get()
+	if !ok || int(nnz) > size {
+		return SparseBOW{}, bad
+	}
+	bow := SparseBOW{
+		Size:    size,
+		Indices: make([]uint32, nnz),
+		Freqs:   make([]uint32, nnz),
+	}
+	i := uint32(0)
+	for k := range bow.Indices {
+		delta, ok1 := get()
+		freq, ok2 := get()
+		i += delta
+		if !ok1 || !ok2 || (k > 0 && delta == 0) || int(i) >= size {
+			return SparseBOW{}, bad
+		}
+		bow.Indices[k], bow.Freqs[k] = i, freq
+	}
+	if len(b) > 0 {
+		return SparseBOW{}, bad
+	}
+	return bow, nil
+}
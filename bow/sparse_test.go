@@ -0,0 +1,116 @@
+package bow
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"testing/quick"
+)
+
+func TestSparseDistances(t *testing.T) {
+	check := func(name string, f func(bowPair) bool) {
+		if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	// Distances computed with sparse BOWs must be identical to distances
+	// computed with BOWs, so that search results don't depend on how
+	// entries are represented.
+	check("Euclid", func(p bowPair) bool {
+		s1, s2 := p.b1.Sparse(), p.b2.Sparse()
+		d := p.b1.Euclid(p.b2)
+		return d == s1.Euclid(s2) && d == s2.Euclid(s1) &&
+			d == s1.EuclidBOW(p.b2) && d == s2.EuclidBOW(p.b1)
+	})
+	check("Cosine", func(p bowPair) bool {
+		s1, s2 := p.b1.Sparse(), p.b2.Sparse()
+		d := p.b1.Cosine(p.b2)
+		return d == s1.Cosine(s2) && d == s1.CosineBOW(p.b2) &&
+			d == s2.CosineBOW(p.b1)
+	})
+	check("Dot", func(p bowPair) bool {
+		s1, s2 := p.b1.Sparse(), p.b2.Sparse()
+		d := p.b1.Dot(p.b2)
+		return d == s1.Dot(s2) && d == s1.DotBOW(p.b2)
+	})
+	check("Convert", func(p bowPair) bool {
+		s := p.b1.Sparse()
+		return s.BOW().Equal(p.b1) && s.String() == p.b1.String()
+	})
+}
+
+func TestSparseEncoding(t *testing.T) {
+	check := func(p bowPair) bool {
+		s := p.b1.Sparse()
+		got, err := decodeSparse(s.encode(), s.Size)
+		return err == nil && got.BOW().Equal(p.b1)
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+
+	// Truncated or out of range encodings must be rejected.
+	rng := rand.New(rand.NewSource(9))
+	for trial := 0; trial < 100; trial++ {
+		var p bowPair
+		p = p.Generate(rng, 0).Interface().(bowPair)
+		s := p.b1.Sparse()
+		if len(s.Indices) == 0 {
+			continue
+		}
+		enc := s.encode()
+		if _, err := decodeSparse(enc[:len(enc)-1], s.Size); err == nil {
+			t.Fatalf("Trial %d: truncated encoding was accepted.", trial)
+		}
+		last := int(s.Indices[len(s.Indices)-1])
+		if _, err := decodeSparse(enc, last); err == nil {
+			t.Fatalf("Trial %d: encoding was accepted with a library of "+
+				"size %d.", trial, last)
+		}
+	}
+}
+
+func TestSparseEntries(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	chains := make([]chain, 20)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("chain%d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Entries stored sparsely only have a sparse BOW in memory, but their
+	// dense BOW is available with DenseBOW.
+	sparse := 0
+	for _, entry := range db.Entries {
+		if entry.IsSparse() {
+			sparse++
+			if entry.BOW.Freqs != nil {
+				t.Fatalf("Sparse entry '%s' also has a BOW.", entry.Id)
+			}
+		}
+	}
+	if sparse == 0 {
+		t.Fatalf("None of the %d entries are sparse.", len(db.Entries))
+	}
+	byId := make(map[string]chain)
+	for _, c := range chains {
+		byId[c.id] = c
+	}
+	for _, entry := range db.Entries {
+		expected := ComputeBOW(library, byId[entry.Id])
+		if !entry.DenseBOW().Equal(expected) {
+			t.Fatalf("Entry '%s' has BOW %s but expected %s.",
+				entry.Id, entry.DenseBOW(), expected)
+		}
+	}
+}
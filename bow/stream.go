@@ -0,0 +1,316 @@
+package bow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// streamChunk is the number of entries handed to a worker at a time when
+// searching a streaming database. At most GOMAXPROCS+1 chunks are held in
+// memory at once.
+const streamChunk = 256
+
+// OpenDBStream opens a BOW database for reading without loading its entries
+// into memory, so that it opens instantly regardless of its size. Entries are
+// read from disk on demand with Iter, and searches read every entry with a
+// buffered reader while keeping only the best results in memory.
+//
+// Since the entries are not in memory, the Entries field is nil, indices are
+// not used and Matrix and MatrixWith cannot be used.
+func OpenDBStream(dir string) (*DB, error) {
+	db, err := openDB(dir)
+	if err != nil {
+		return nil, err
+	}
+	db.stream = true
+
+	db.DocFreqs, err = db.readDocFreqs()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Iterator iterates over the entries of a BOW database in the order they
+// were written. It should be used like so:
+//
+//	it := db.Iter()
+//	defer it.Close()
+//	for it.Next() {
+//		entry := it.Entry()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Many iterators may be used at the same time.
+type Iterator struct {
+	db    *DB
+	index int
+	entry Entry
+	err   error
+
+	// Only set when reading from disk. offset is the offset of the current
+	// entry's record in bow.db and next is the offset of the next record.
+	file   *os.File
+	r      *bufio.Reader
+	buf    []byte
+	offset int64
+	next   int64
+}
+
+// Iter returns an iterator over every entry in the database. If the database
+// was opened with OpenDBStream, entries are read from disk. Otherwise, the
+// entries in memory are used.
+func (db *DB) Iter() *Iterator {
+	if !db.stream {
+		return &Iterator{db: db, index: -1}
+	}
+	return db.iterFile()
+}
+
+// iterFile returns an iterator that reads every entry from disk.
+func (db *DB) iterFile() *Iterator {
+	it := &Iterator{db: db, index: -1}
+	it.file, it.err = os.Open(db.filePath("bow.db"))
+	if it.err == nil {
+		it.r = bufio.NewReaderSize(it.file, 1<<16)
+		_, it.err = it.r.Discard(db.headerLen)
+		it.next = int64(db.headerLen)
+	}
+	return it
+}
+
+// Next advances the iterator to the next entry, and returns false when there
+// are no more entries or if there was an error.
+//
+// When reading from disk, only the number of entries given by the header of
+// bow.db are read. Any records after them were appended by an update that
+// wasn't completed, and are ignored.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.index++
+	if it.file == nil {
+		if it.index >= len(it.db.Entries) {
+			return false
+		}
+		it.entry = it.db.Entries[it.index]
+		return true
+	}
+
+	for ; ; it.index++ {
+		if h := it.db.header; h != nil && uint64(it.index) >= h.Entries {
+			it.Close()
+			return false
+		}
+		entry, err := it.read()
+		if err != nil {
+			if err != io.EOF {
+				it.err = err
+			} else if h := it.db.header; h != nil {
+				it.err = fmt.Errorf("'%s' has %d entries, but its header "+
+					"says it has %d. It may be truncated.",
+					it.db.filePath("bow.db"), it.index, h.Entries)
+			}
+			it.Close()
+			return false
+		}
+		if !it.db.deleted[it.index] {
+			it.entry = entry
+			return true
+		}
+	}
+}
+
+// Entry returns the current entry of the iterator.
+func (it *Iterator) Entry() Entry {
+	return it.entry
+}
+
+// Index returns the position of the current entry in the database. When
+// reading from disk, deleted entries are counted.
+func (it *Iterator) Index() int {
+	return it.index
+}
+
+// Err returns the first error encountered by the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources used by the iterator. It is called
+// automatically when Next returns false.
+func (it *Iterator) Close() error {
+	if it.file == nil {
+		return nil
+	}
+	err := it.file.Close()
+	it.file = nil
+	return err
+}
+
+// read will read a single entry from the BOW database.
+func (it *Iterator) read() (Entry, error) {
+	entry, n, err := it.db.readRecord(it.r, &it.buf, it.index)
+	if err != nil {
+		return Entry{}, err
+	}
+	it.offset = it.next
+	it.next += n
+	return entry, nil
+}
+
+// readRecord reads the record of a single entry from r: the length of the
+// entry, the entry and its checksum (if the database has a header). It
+// returns the entry and the length of the record in bytes. If buf is big
+// enough, it is used to read the entry. Otherwise, it is replaced by a
+// bigger buffer. position is only used in error messages.
+func (db *DB) readRecord(
+	r io.Reader,
+	buf *[]byte,
+	position int,
+) (Entry, int64, error) {
+	// Find the number of bytes used by the next entry.
+	var entryLenBs [4]byte
+	if _, err := io.ReadFull(r, entryLenBs[:]); err != nil {
+		// Test the first read to see if we're at the end.
+		// This is the only place where it's OK to see an EOF.
+		if err == io.EOF {
+			return Entry{}, 0, err
+		}
+		return Entry{}, 0, fmt.Errorf("Error reading entry length: %s", err)
+	}
+	entryLen := readUint32(entryLenBs[:])
+	n := 4 + int64(entryLen)
+
+	// Read in the full entry.
+	if int(entryLen) > cap(*buf) {
+		*buf = make([]byte, entryLen)
+	}
+	entry := (*buf)[0:entryLen]
+	if _, err := io.ReadFull(r, entry); err != nil {
+		return Entry{}, 0, fmt.Errorf("Error reading entry: %s", err)
+	}
+	if db.header != nil {
+		var sum [4]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return Entry{}, 0, fmt.Errorf("Error reading checksum: %s", err)
+		}
+		if checksum(entry) != readUint32(sum[:]) {
+			return Entry{}, 0, fmt.Errorf("Entry %d in '%s' is corrupt "+
+				"(bad checksum).", position, db.filePath("bow.db"))
+		}
+		n += 4
+	}
+	decoded, err := db.decode(entry)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	decoded.Meta = db.meta[decoded.Id]
+	return decoded, n, nil
+}
+
+// mustLoad panics if the entries of the database are not in memory.
+func (db *DB) mustLoad() {
+	if db.stream {
+		panic(fmt.Sprintf("The entries of BOW database '%s' are not in "+
+			"memory. It must be opened with OpenDB.", db))
+	}
+}
+
+// streamJob is a chunk of consecutive entries to be searched by a worker.
+type streamJob struct {
+	start   int
+	entries []Entry
+}
+
+// SearchStream searches a database opened with OpenDBStream by reading its
+// entries from disk, and returns any error encountered while reading them
+// (e.g., when bow.db is truncated or corrupt). Other databases are searched
+// with SearchEntry. Use Query to compute the query entry for a value.
+func (db *DB) SearchStream(
+	opts SearchOptions,
+	query Entry,
+) ([]SearchResult, error) {
+	if !db.stream {
+		return db.SearchEntry(opts, query)
+	}
+	if opts.SortBy == nil {
+		panic("No metric given in SortBy.")
+	}
+
+	wquery := db.DocFreqs.Weigh(opts.Weighting, query)
+	workers := max(1, runtime.GOMAXPROCS(0))
+	jobs := make(chan streamJob, 1)
+	bests := make([]*topk, workers)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		bests[w] = newTopK(opts.Limit, opts.Order)
+		wg.Add(1)
+		go func(best *topk) {
+			defer wg.Done()
+			for job := range jobs {
+				db.searchChunk(opts, wquery, job, best)
+			}
+		}(bests[w])
+	}
+
+	it := db.iterFile()
+	job := streamJob{start: 0}
+	for it.Next() {
+		job.entries = append(job.entries, it.Entry())
+		if len(job.entries) == streamChunk {
+			jobs <- job
+			job = streamJob{start: it.Index() + 1}
+		}
+	}
+	if len(job.entries) > 0 {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	best := bests[0]
+	for _, other := range bests[1:] {
+		best.merge(other)
+	}
+	hits := best.sorted()
+	results := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		wentry := db.DocFreqs.Weigh(opts.Weighting, h.Entry)
+		results[i] = newSearchResult(h.Entry, wquery, wentry,
+			opts.SortBy, h.distance)
+	}
+	return results, nil
+}
+
+// searchChunk adds the best hits for the query in a chunk of entries to
+// best.
+func (db *DB) searchChunk(
+	opts SearchOptions,
+	wquery Entry,
+	job streamJob,
+	best *topk,
+) {
+	for i, entry := range job.entries {
+		if !opts.keep(wquery, entry) {
+			continue
+		}
+		wentry := db.DocFreqs.Weigh(opts.Weighting, entry)
+		dist := opts.SortBy.Distance(wquery, wentry)
+		if dist > opts.Max || dist < opts.Min {
+			continue
+		}
+		best.add(hit{entry, dist, job.start + i})
+	}
+}
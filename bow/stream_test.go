@@ -0,0 +1,159 @@
+package bow
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// saveDB writes the entries of a database in memory to a new directory and
+// returns its path. The caller should remove the parent of the directory when
+// done. bow.db is written with the format version given, or without a header
+// if the version is 0.
+func saveDB(t *testing.T, db *DB, version int) string {
+	dir, err := ioutil.TempDir("", "bowdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = path.Join(dir, "test")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	libf, err := os.Create(path.Join(dir, "frag.lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer libf.Close()
+	if err := db.Lib.Save(libf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &DB{Lib: db.Lib, Path: dir, writeBuf: new(bytes.Buffer)}
+	if w.file, err = os.Create(w.filePath("bow.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer w.file.Close()
+	if version > 0 {
+		w.header = w.newHeader()
+		w.header.Version = uint16(version)
+		if _, err := w.file.Write(w.header.bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range db.Entries {
+		if err := w.write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version > 0 {
+		if err := w.writeHeader(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	mem := randomDB(rng, 3000, 20)
+	dir := saveDB(t, mem, dbVersion)
+	defer os.RemoveAll(path.Dir(dir))
+
+	loaded, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := OpenDBStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Entries != nil {
+		t.Fatalf("Streaming database has %d entries in memory.",
+			len(stream.Entries))
+	}
+
+	it := stream.Iter()
+	for it.Next() {
+		got, expected := it.Entry(), loaded.Entries[it.Index()]
+		if got.Id != expected.Id || !got.DenseBOW().Equal(expected.DenseBOW()) {
+			t.Fatalf("Entry %d is %s but expected %s.",
+				it.Index(), got.Id, expected.Id)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Index() != len(loaded.Entries) {
+		t.Fatalf("Iterated over %d entries but expected %d.",
+			it.Index(), len(loaded.Entries))
+	}
+
+	for trial := 0; trial < 20; trial++ {
+		query := loaded.Entries[rng.Intn(len(loaded.Entries))]
+		opts := SearchDefault
+		opts.Limit = rng.Intn(40) - 5
+		opts.Order = []int{OrderAsc, OrderDesc}[rng.Intn(2)]
+		opts.SortBy = Metrics[rng.Intn(len(Metrics))]
+		opts.Weighting = rng.Intn(3)
+
+		expected := mustSearch(t, loaded, opts, query)
+		got, err := stream.SearchStream(opts, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) != len(got) {
+			t.Fatalf("Trial %d: expected %d results but got %d.",
+				trial, len(expected), len(got))
+		}
+		for i := range expected {
+			if expected[i].Id != got[i].Id ||
+				expected[i].Distance != got[i].Distance ||
+				expected[i].Cosine != got[i].Cosine {
+				t.Fatalf("Trial %d: result %d is (%s, %f) but expected "+
+					"(%s, %f).", trial, i, got[i].Id, got[i].Distance,
+					expected[i].Id, expected[i].Distance)
+			}
+		}
+	}
+}
+
+func TestStreamCorrupt(t *testing.T) {
+	rng := rand.New(rand.NewSource(19))
+	mem := randomDB(rng, 100, 10)
+	dir := saveDB(t, mem, dbVersion)
+	defer os.RemoveAll(path.Dir(dir))
+	stream, err := OpenDBStream(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SearchEntry searches a streaming database too.
+	query := mem.Entries[0]
+	opts := SearchDefault
+	opts.Limit = -1
+	if got := mustSearch(t, stream, opts, query); len(got) != 100 {
+		t.Fatalf("Expected 100 results but got %d.", len(got))
+	}
+
+	// Corrupt the last entry, so that its checksum doesn't match.
+	fp := path.Join(dir, "bow.db")
+	bs, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[len(bs)-5] ^= 0xff
+	if err := ioutil.WriteFile(fp, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stream.SearchStream(opts, query); err == nil {
+		t.Fatalf("Searching a corrupt database did not return an error.")
+	}
+	if _, err := stream.SearchEntry(opts, query); err == nil {
+		t.Fatalf("Searching a corrupt database did not return an error.")
+	}
+}
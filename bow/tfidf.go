@@ -0,0 +1,214 @@
+package bow
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Weighting schemes that may be applied to BOW vectors before computing
+// distances in a search. Without weighting, common fragments (like those
+// found in helices and strands) dominate the distance between BOWs.
+//
+// WeightTFIDF multiplies each fragment frequency by the smoothed inverse
+// document frequency of that fragment:
+//
+//	tf * (log((N + 1) / (df + 1)) + 1)
+//
+// WeightBM25 uses the Okapi BM25 term weight with k1 = 1.2 and b = 0.75,
+// which also dampens large frequencies and normalizes by BOW size:
+//
+//	idf * tf * (k1 + 1) / (tf + k1 * (1 - b + b * len / avglen))
+//	idf = log(1 + (N - df + 0.5) / (df + 0.5))
+//
+// Where N is the number of entries in the database, df is the number of
+// entries containing the fragment and len is the sum of all frequencies in
+// a BOW.
+const (
+	WeightNone = iota
+	WeightTFIDF
+	WeightBM25
+)
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// DocFreqs holds the document frequency of every fragment in a BOW database.
+// i.e., the number of entries in which each fragment occurs at least once.
+type DocFreqs struct {
+	// The number of entries in the database.
+	Entries int
+
+	// The number of entries containing each fragment.
+	Freqs []uint32
+
+	// The sum of the lengths of all entries, where the length of an entry is
+	// the sum of its fragment frequencies (or weights).
+	TotalLen float64
+}
+
+// NewDocFreqs returns document frequencies for an empty database with a
+// library of the given size.
+func NewDocFreqs(size int) *DocFreqs {
+	return &DocFreqs{Freqs: make([]uint32, size)}
+}
+
+// Add updates the document frequencies with a new entry.
+func (df *DocFreqs) Add(entry Entry) {
+	df.Entries++
+	if entry.IsWeighted() {
+		for i, w := range entry.Weighted.Weights {
+			if w > 0 {
+				df.Freqs[i]++
+			}
+			df.TotalLen += w
+		}
+		return
+	}
+	if entry.IsSparse() {
+		for k, i := range entry.Sparse.Indices {
+			df.Freqs[i]++
+			df.TotalLen += float64(entry.Sparse.Freqs[k])
+		}
+		return
+	}
+	for i, f := range entry.BOW.Freqs {
+		if f > 0 {
+			df.Freqs[i]++
+		}
+		df.TotalLen += float64(f)
+	}
+}
+
+// Remove updates the document frequencies when an entry is deleted.
+func (df *DocFreqs) Remove(entry Entry) {
+	df.Entries--
+	if entry.IsWeighted() {
+		for i, w := range entry.Weighted.Weights {
+			if w > 0 {
+				df.Freqs[i]--
+			}
+			df.TotalLen -= w
+		}
+		return
+	}
+	for i, f := range entry.DenseBOW().Freqs {
+		if f > 0 {
+			df.Freqs[i]--
+		}
+		df.TotalLen -= float64(f)
+	}
+}
+
+// Weigh returns a weighted entry corresponding to the given entry with the
+// weighting scheme given applied to its BOW. The entry returned always has
+// a weighted BOW. With WeightNone, the entry is returned unchanged.
+func (df *DocFreqs) Weigh(weighting int, entry Entry) Entry {
+	if weighting == WeightNone {
+		return entry
+	}
+
+	tfs := entry.weighted().Weights
+	weights := make([]float64, len(tfs))
+	n := float64(df.Entries)
+	switch weighting {
+	case WeightTFIDF:
+		for i, tf := range tfs {
+			idf := math.Log((n+1)/(float64(df.Freqs[i])+1)) + 1
+			weights[i] = tf * idf
+		}
+	case WeightBM25:
+		length := 0.0
+		for _, tf := range tfs {
+			length += tf
+		}
+		norm := bm25K1 * (1 - bm25B)
+		if avglen := df.TotalLen / n; df.Entries > 0 && avglen > 0 {
+			norm += bm25K1 * bm25B * length / avglen
+		}
+		for i, tf := range tfs {
+			dfi := float64(df.Freqs[i])
+			idf := math.Log(1 + (n-dfi+0.5)/(dfi+0.5))
+			weights[i] = idf * tf * (bm25K1 + 1) / (tf + norm)
+		}
+	default:
+		panic(fmt.Sprintf("Unrecognized weighting scheme: %d", weighting))
+	}
+	return Entry{
+		Id:       entry.Id,
+		Data:     entry.Data,
+		Meta:     entry.Meta,
+		BOW:      entry.BOW,
+		Sparse:   entry.Sparse,
+		Weighted: WeightedBOW{weights},
+	}
+}
+
+// readDocFreqs reads the document frequencies stored in the database. If
+// they don't exist (i.e., for databases created before they were stored),
+// they are computed from the entries in the database.
+func (db *DB) readDocFreqs() (*DocFreqs, error) {
+	f, err := os.Open(db.filePath("frag.df"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		df := NewDocFreqs(db.Lib.Size())
+		it := db.Iter()
+		for it.Next() {
+			df.Add(it.Entry())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		return df, nil
+	}
+	defer f.Close()
+
+	var df DocFreqs
+	if err := gob.NewDecoder(f).Decode(&df); err != nil {
+		return nil, fmt.Errorf("Could not read document frequencies: %s", err)
+	}
+	return &df, nil
+}
+
+// writeDocFreqs writes the document frequencies of the database.
+func (db *DB) writeDocFreqs() error {
+	f, err := db.createFile("frag.df")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(*db.DocFreqs); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write document frequencies: %s", err)
+	}
+	return closeFile(f)
+}
+
+// weightedEntries returns every entry in the database with the given
+// weighting scheme applied. The weighted entries are computed once for each
+// weighting scheme and cached.
+func (db *DB) weightedEntries(weighting int) []Entry {
+	if weighting == WeightNone {
+		return db.Entries
+	}
+
+	db.weightedLock.Lock()
+	defer db.weightedLock.Unlock()
+
+	if db.weighted == nil {
+		db.weighted = make(map[int][]Entry)
+	}
+	if entries, ok := db.weighted[weighting]; ok {
+		return entries
+	}
+	entries := make([]Entry, len(db.Entries))
+	for i, entry := range db.Entries {
+		entries[i] = db.DocFreqs.Weigh(weighting, entry)
+	}
+	db.weighted[weighting] = entries
+	return entries
+}
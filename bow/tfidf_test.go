@@ -0,0 +1,119 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// tfidfEntries returns entries with the frequencies [2 0 1], [0 1 1] and
+// [1 0 0]. The second one is sparse.
+func tfidfEntries() []Entry {
+	return []Entry{
+		{Id: "a", BOW: BOW{[]uint32{2, 0, 1}}},
+		{Id: "b", Sparse: BOW{[]uint32{0, 1, 1}}.Sparse()},
+		{Id: "c", BOW: BOW{[]uint32{1, 0, 0}}},
+	}
+}
+
+func TestDocFreqs(t *testing.T) {
+	df := NewDocFreqs(3)
+	for _, entry := range tfidfEntries() {
+		df.Add(entry)
+	}
+	expected := DocFreqs{Entries: 3, Freqs: []uint32{2, 1, 2}, TotalLen: 6}
+	if fmt.Sprint(*df) != fmt.Sprint(expected) {
+		t.Fatalf("Document frequencies are %v but expected %v.",
+			*df, expected)
+	}
+
+	df.Remove(tfidfEntries()[1])
+	expected = DocFreqs{Entries: 2, Freqs: []uint32{2, 0, 1}, TotalLen: 4}
+	if fmt.Sprint(*df) != fmt.Sprint(expected) {
+		t.Fatalf("After removing an entry, document frequencies are %v "+
+			"but expected %v.", *df, expected)
+	}
+}
+
+func TestWeigh(t *testing.T) {
+	df := NewDocFreqs(3)
+	for _, entry := range tfidfEntries() {
+		df.Add(entry)
+	}
+	query := tfidfEntries()[0]
+
+	// N = 3, df = [2 1 2], so the TF-IDF weight of a fragment in the
+	// query is tf * (log(4/3) + 1).
+	idf := math.Log(4.0/3.0) + 1
+	tfidf := []float64{2 * idf, 0, idf}
+
+	// The average length is 6/3 = 2 and the query has length 3, so
+	// tf is normalized by k1 * (1 - b + b * 3/2) = 1.65. The idf of
+	// fragments 0 and 2 is log(1 + (3 - 2 + 0.5) / (2 + 0.5)) = log(1.6).
+	bm25 := []float64{
+		math.Log(1.6) * 2 * 2.2 / (2 + 1.65),
+		0,
+		math.Log(1.6) * 1 * 2.2 / (1 + 1.65),
+	}
+
+	tests := []struct {
+		weighting int
+		expected  []float64
+	}{
+		{WeightTFIDF, tfidf},
+		{WeightBM25, bm25},
+	}
+	for _, test := range tests {
+		got := df.Weigh(test.weighting, query)
+		if got.Id != query.Id || !got.IsWeighted() {
+			t.Fatalf("Weighting %d: expected a weighted entry '%s'.",
+				test.weighting, query.Id)
+		}
+		for i, w := range test.expected {
+			if math.Abs(got.Weighted.Weights[i]-w) > 1e-12 {
+				t.Fatalf("Weighting %d: weight of fragment %d is %f but "+
+					"expected %f.", test.weighting, i,
+					got.Weighted.Weights[i], w)
+			}
+		}
+	}
+	if got := df.Weigh(WeightNone, query); got.IsWeighted() {
+		t.Fatalf("No weighting returned a weighted entry.")
+	}
+}
+
+func TestDocFreqsFile(t *testing.T) {
+	rng := rand.New(rand.NewSource(16))
+	chains := make([]chain, 20)
+	for i := range chains {
+		chains[i] = randomChain(rng, fmt.Sprintf("c%02d", i))
+	}
+	dir := createTestDB(t, chains)
+	defer os.RemoveAll(path.Dir(dir))
+
+	expected := NewDocFreqs(library.Size())
+	for _, c := range chains {
+		expected.Add(Entry{BOW: ComputeBOW(library, c)})
+	}
+
+	// Document frequencies are read from frag.df, or computed from the
+	// entries of databases without it.
+	for _, remove := range []bool{false, true} {
+		if remove {
+			if err := os.Remove(path.Join(dir, "frag.df")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db, err := OpenDB(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(*db.DocFreqs) != fmt.Sprint(*expected) {
+			t.Fatalf("Document frequencies are %v but expected %v.",
+				*db.DocFreqs, *expected)
+		}
+	}
+}
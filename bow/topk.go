@@ -0,0 +1,113 @@
+package bow
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// hit is a single candidate search result: an entry, its distance to the
+// query and its position in the database.
+type hit struct {
+	Entry
+	distance float64
+	index    int
+}
+
+// topk keeps the best `limit` hits added to it, where "best" depends on the
+// order of the search. It is a heap with the worst hit at the root, so that
+// deciding whether a new hit is good enough takes constant time and
+// replacing the worst hit takes logarithmic time.
+//
+// Hits with equal distances are ordered by entry Id and then by their
+// position in the database, so that results are always deterministic.
+//
+// If limit is negative, every hit is kept.
+type topk struct {
+	limit int
+	order int
+	hits  []hit
+}
+
+// topkCapacity is the largest number of hits allocated up front by a topk,
+// so that a large limit used to mean "every hit" doesn't allocate memory for
+// hits that are never found.
+const topkCapacity = 1024
+
+func newTopK(limit, order int) *topk {
+	capacity := min(limit, topkCapacity)
+	if limit < 0 {
+		capacity = 100
+	}
+	return &topk{
+		limit: limit,
+		order: order,
+		hits:  make([]hit, 0, capacity),
+	}
+}
+
+// better returns true if h1 should come before h2 in the search results.
+func (tk *topk) better(h1, h2 hit) bool {
+	if h1.distance != h2.distance {
+		if tk.order == OrderDesc {
+			return h1.distance > h2.distance
+		}
+		return h1.distance < h2.distance
+	}
+	if h1.Id != h2.Id {
+		return h1.Id < h2.Id
+	}
+	return h1.index < h2.index
+}
+
+// add considers a new hit, and keeps it if it is one of the best `limit`
+// hits seen so far.
+func (tk *topk) add(h hit) {
+	switch {
+	case tk.limit < 0:
+		tk.hits = append(tk.hits, h)
+	case len(tk.hits) < tk.limit:
+		heap.Push(tk, h)
+	case tk.limit > 0 && tk.better(h, tk.hits[0]):
+		tk.hits[0] = h
+		heap.Fix(tk, 0)
+	}
+}
+
+// merge adds every hit in tk2 to tk.
+func (tk *topk) merge(tk2 *topk) {
+	for _, h := range tk2.hits {
+		tk.add(h)
+	}
+}
+
+// sorted returns the hits kept, from best to worst.
+// The topk should not be used after calling sorted.
+func (tk *topk) sorted() []hit {
+	sort.Sort(bestFirst{tk})
+	return tk.hits
+}
+
+// The heap interface. The root of the heap is the worst hit.
+
+func (tk *topk) Len() int           { return len(tk.hits) }
+func (tk *topk) Less(i, j int) bool { return tk.better(tk.hits[j], tk.hits[i]) }
+func (tk *topk) Push(x interface{}) { tk.hits = append(tk.hits, x.(hit)) }
+
+func (tk *topk) Swap(i, j int) {
+	tk.hits[i], tk.hits[j] = tk.hits[j], tk.hits[i]
+}
+
+func (tk *topk) Pop() interface{} {
+	h := tk.hits[len(tk.hits)-1]
+	tk.hits = tk.hits[:len(tk.hits)-1]
+	return h
+}
+
+// bestFirst sorts hits from best to worst.
+type bestFirst struct {
+	*topk
+}
+
+func (bf bestFirst) Less(i, j int) bool {
+	return bf.better(bf.hits[i], bf.hits[j])
+}
@@ -0,0 +1,285 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// OpenDBUpdate opens an existing BOW database so that it can be modified.
+// New entries can be added with Add and AddSequence, existing entries can be
+// deleted with Delete or replaced with Replace and ReplaceSequence. Close
+// must be called to save the changes.
+//
+// New entries are appended to bow.db and deleted entries are recorded as
+// tombstones in the database directory, so that neither requires rewriting
+// the database. Deleted entries are skipped when the database is read, but
+// they still use space on disk until the database is compacted with
+// CompactDB.
+//
+// The database may be searched while it is being updated, but since the
+// index refers to entries by their position in memory, it is discarded as
+// soon as an entry is added or deleted. If the database had an index, it is
+// rebuilt when the database is closed.
+func OpenDBUpdate(dir string) (*DB, error) {
+	db, err := OpenDB(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := db.filePath("bow.db")
+	db.file, err = os.OpenFile(fp, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open '%s': %s", fp, err)
+	}
+
+	// Records after the entries counted by the header (from an update that
+	// wasn't completed) are discarded, so that new entries follow the last
+	// entry that was read.
+	db.updateSize, db.updateRecords = db.offset, db.records
+	if err := db.file.Truncate(db.updateSize); err != nil {
+		db.file.Close()
+		return nil, fmt.Errorf("Could not truncate '%s': %s", fp, err)
+	}
+	if _, err := db.file.Seek(db.updateSize, io.SeekStart); err != nil {
+		db.file.Close()
+		return nil, fmt.Errorf("Could not seek in '%s': %s", fp, err)
+	}
+	if db.Index != nil {
+		db.indexed, db.indexSeed = true, db.Index.Seed
+	}
+
+	// When there are several entries with the same Id (only possible in
+	// databases created before duplicate Ids were rejected), the Id index
+	// has the first one.
+	db.ids = make(map[string]idRecord, len(db.Entries))
+	for i, entry := range db.Entries {
+		if _, ok := db.ids[entry.Id]; !ok {
+			db.ids[entry.Id] = idRecord{
+				entry.Id, db.offsets[i], db.positions[i], -1,
+			}
+		}
+	}
+
+	db.updating, db.staging = true, true
+	db.writeBuf = new(bytes.Buffer)
+	db.writing = make(chan bowJob)
+	db.startWorkers(context.Background())
+	return db, nil
+}
+
+// Delete removes every entry with the given Id from the database, and
+// returns the number of entries removed.
+//
+// Since BOWs are computed concurrently, entries added with Add or
+// AddSequence may not be written yet, in which case they aren't removed.
+//
+// Delete will panic if the database was not opened with OpenDBUpdate.
+func (db *DB) Delete(id string) int {
+	if !db.updating {
+		panic("Cannot delete from a BOW database unless it is opened with " +
+			"OpenDBUpdate.")
+	}
+
+	db.updateLock.Lock()
+	removed := db.removeWhere(func(i int) bool {
+		return db.Entries[i].Id == id
+	})
+	delete(db.ids, id)
+	db.setMetadata(id, nil)
+	db.updateLock.Unlock()
+
+	db.seqLock.Lock()
+	delete(db.submitted, id)
+	db.seqLock.Unlock()
+	return removed
+}
+
+// removeWhere deletes every entry in memory for which the predicate given
+// returns true, and returns the number of entries deleted. The predicate is
+// given the index of an entry in db.Entries. db.updateLock must be held.
+func (db *DB) removeWhere(pred func(i int) bool) int {
+	removed := 0
+	keep := 0
+	for i, entry := range db.Entries {
+		if pred(i) {
+			db.deleted[db.positions[i]] = true
+			db.DocFreqs.Remove(entry)
+			removed++
+			continue
+		}
+		db.Entries[keep] = entry
+		db.positions[keep] = db.positions[i]
+		db.offsets[keep] = db.offsets[i]
+		keep++
+	}
+	db.Entries = db.Entries[:keep]
+	db.positions = db.positions[:keep]
+	db.offsets = db.offsets[:keep]
+	db.entriesChanged()
+	return removed
+}
+
+// Replace deletes every entry with the same Id as the given value, and then
+// adds the value to the database.
+//
+// Replace will panic if the database was not opened with OpenDBUpdate.
+func (db *DB) Replace(bower StructureBower) error {
+	db.Delete(bower.Id())
+	return db.Add(bower)
+}
+
+// ReplaceSequence is just like Replace, except it replaces a value
+// implementing the SequenceBower interface.
+func (db *DB) ReplaceSequence(bower SequenceBower) error {
+	db.Delete(bower.Id())
+	return db.AddSequence(bower)
+}
+
+// closeUpdate saves the index of a database opened with OpenDBUpdate.
+func (db *DB) closeUpdate() error {
+	if !db.indexed {
+		return nil
+	}
+
+	// The index refers to entries by their position in memory, so it must
+	// be rebuilt.
+	db.Index = db.buildIndex(db.indexSeed)
+	return db.writeIndex()
+}
+
+// CompactDB rewrites the BOW database in dir without the entries that have
+// been deleted. Databases without a header are upgraded to the current
+// format.
+func CompactDB(dir string) error {
+	db, err := OpenDB(dir)
+	if err != nil {
+		return err
+	}
+
+	fp := db.filePath("bow.db")
+	tmp := fp + ".tmp"
+	db.file, err = os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Could not create '%s': %s", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	gen := db.generation() + 1
+	db.writeBuf = new(bytes.Buffer)
+	db.header, db.records = db.newHeader(), 0
+	db.header.Generation = gen
+	header := db.header.bytes()
+	if _, err := db.file.Write(header); err != nil {
+		db.file.Close()
+		return fmt.Errorf("Could not write header of '%s': %s", tmp, err)
+	}
+	db.offset = int64(len(header))
+	db.ids = make(map[string]idRecord, len(db.Entries))
+	for _, entry := range db.Entries {
+		offset := db.offset
+		if err := db.write(entry); err != nil {
+			db.file.Close()
+			return err
+		}
+		if _, ok := db.ids[entry.Id]; !ok {
+			db.ids[entry.Id] = idRecord{
+				entry.Id, offset, db.records - 1, -1,
+			}
+		}
+	}
+	if err := db.writeHeader(); err != nil {
+		db.file.Close()
+		return err
+	}
+	if err := db.file.Close(); err != nil {
+		return fmt.Errorf("Could not write '%s': %s", tmp, err)
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		return fmt.Errorf("Could not replace '%s': %s", fp, err)
+	}
+
+	// The compacted bow.db has a new generation, so if the tombstones and
+	// Id index of the old one aren't replaced below, they are ignored.
+	db.staging = true
+	db.deleted = nil
+	if err := db.writeTombstones(); err != nil {
+		return err
+	}
+	if err := db.writeIds(); err != nil {
+		db.discardFiles()
+		return err
+	}
+	if err := db.commitFiles(); err != nil {
+		db.discardFiles()
+		return err
+	}
+	return nil
+}
+
+// readTombstones reads the positions of the deleted entries in bow.db, if
+// there are any. Tombstones written for another generation of bow.db are
+// ignored.
+func (db *DB) readTombstones() (map[int]bool, error) {
+	f, err := os.Open(db.filePath("bow.del"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var gen uint64
+	var positions []int
+	dec := gob.NewDecoder(f)
+	if err := dec.Decode(&gen); err != nil {
+		return nil, fmt.Errorf("Could not read deleted entries: %s", err)
+	}
+	if gen != db.generation() {
+		// Left behind by an interrupted compaction, which removed every
+		// deleted entry from bow.db.
+		return nil, nil
+	}
+	if err := dec.Decode(&positions); err != nil {
+		return nil, fmt.Errorf("Could not read deleted entries: %s", err)
+	}
+	deleted := make(map[int]bool, len(positions))
+	for _, p := range positions {
+		deleted[p] = true
+	}
+	return deleted, nil
+}
+
+// writeTombstones writes the positions of the deleted entries in bow.db.
+// If there are none, the file is removed.
+func (db *DB) writeTombstones() error {
+	if len(db.deleted) == 0 {
+		return db.removeFile("bow.del")
+	}
+
+	positions := make([]int, 0, len(db.deleted))
+	for p := range db.deleted {
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+
+	f, err := db.createFile("bow.del")
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(db.generation())
+	if err == nil {
+		err = enc.Encode(positions)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write deleted entries: %s", err)
+	}
+	return closeFile(f)
+}
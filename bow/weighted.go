@@ -0,0 +1,134 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// WeightedBOW is a bag-of-words vector where each fragment has a real valued
+// weight instead of an integer frequency. It is produced by soft assignment
+// of fragments, where each window of atoms spreads its vote across several
+// fragments.
+//
+// WeightedBOW supports the same distance computations as BOW. A BOW can be
+// converted to a WeightedBOW with (BOW).Weighted.
+type WeightedBOW struct {
+	// Weights is a map from fragment number to the weight of that fragment
+	// in this "bag of words." This map always has size equivalent to the
+	// size of the library.
+	Weights []float64
+}
+
+// NewWeightedBow returns a weighted bag-of-words with all fragment weights
+// set to 0.
+func NewWeightedBow(size int) WeightedBOW {
+	return WeightedBOW{
+		Weights: make([]float64, size),
+	}
+}
+
+// Weighted converts a bag-of-words to a weighted bag-of-words, where the
+// weight of each fragment is its frequency.
+func (bow BOW) Weighted() WeightedBOW {
+	wbow := NewWeightedBow(bow.Len())
+	for i, freq := range bow.Freqs {
+		wbow.Weights[i] = float64(freq)
+	}
+	return wbow
+}
+
+// Len returns the size of the vector. This is always equivalent to the
+// corresponding library's fragment size.
+func (bow WeightedBOW) Len() int {
+	return len(bow.Weights)
+}
+
+// Equal tests whether two weighted BOWs are equal.
+//
+// Two weighted BOWs are equivalent when the weights of every fragment are
+// equal.
+func (bow1 WeightedBOW) Equal(bow2 WeightedBOW) bool {
+	if bow1.Len() != bow2.Len() {
+		return false
+	}
+	for i, w1 := range bow1.Weights {
+		if w1 != bow2.Weights[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Add performs an add operation on each fragment weight and returns
+// a new weighted BOW. Add will panic if the operands have different lengths.
+func (bow1 WeightedBOW) Add(bow2 WeightedBOW) WeightedBOW {
+	if bow1.Len() != bow2.Len() {
+		panic("Cannot add two BOWs with differing lengths")
+	}
+
+	sum := NewWeightedBow(bow1.Len())
+	for i := range sum.Weights {
+		sum.Weights[i] = bow1.Weights[i] + bow2.Weights[i]
+	}
+	return sum
+}
+
+// Euclid returns the euclidean distance between bow1 and bow2.
+func (bow1 WeightedBOW) Euclid(bow2 WeightedBOW) float64 {
+	w1, w2 := bow1.Weights, bow2.Weights
+	squareSum := 0.0
+	for i := range w1 {
+		squareSum += (w2[i] - w1[i]) * (w2[i] - w1[i])
+	}
+	return math.Sqrt(squareSum)
+}
+
+// Cosine returns the cosine distance between bow1 and bow2.
+func (bow1 WeightedBOW) Cosine(bow2 WeightedBOW) float64 {
+	var dot, mag1, mag2 float64
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		dot += w1[i] * w2[i]
+		mag1 += w1[i] * w1[i]
+		mag2 += w2[i] * w2[i]
+	}
+	r := 1.0 - (dot / math.Sqrt(mag1*mag2))
+	if math.IsNaN(r) {
+		return 1.0
+	}
+	return r
+}
+
+// Dot returns the dot product of bow1 and bow2.
+func (bow1 WeightedBOW) Dot(bow2 WeightedBOW) float64 {
+	dot := 0.0
+	w1, w2 := bow1.Weights, bow2.Weights
+	for i := range w1 {
+		dot += w1[i] * w2[i]
+	}
+	return dot
+}
+
+// Magnitude returns the vector length of the weighted bow.
+func (bow WeightedBOW) Magnitude() float64 {
+	mag := 0.0
+	for _, w := range bow.Weights {
+		mag += w * w
+	}
+	return math.Sqrt(mag)
+}
+
+// String returns a string representation of the weighted BOW vector. Only
+// fragments with non-zero weight are emitted.
+//
+// The output looks like '{fragNum: weight, fragNum: weight, ...}'.
+func (bow WeightedBOW) String() string {
+	pieces := make([]string, 0, 10)
+	for i, w := range bow.Weights {
+		if w != 0 {
+			pieces = append(pieces, fmt.Sprintf("%d: %0.4f", i, w))
+		}
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pieces, ", "))
+}
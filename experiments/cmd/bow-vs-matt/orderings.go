@@ -56,7 +56,8 @@ func (c chain) String() string {
 func getBowOrdering(db *bow.DB,
 	opts bow.SearchOptions, bower bow.Bower) ordering {
 
-	results := db.Search(opts, bower)
+	results, err := db.Search(opts, bower)
+	util.Assert(err)
 
 	ordered := make(ordering, len(results))
 	for i, result := range results {
@@ -23,7 +23,8 @@ func main() {
 
 	fmt.Println("QueryID\tResultID\tCosine\tEuclid")
 	for _, entry := range db.Entries {
-		results := db.SearchEntry(bowOpts, entry)
+		results, err := db.SearchEntry(bowOpts, entry)
+		util.Assert(err)
 
 		for _, result := range results {
 			fmt.Printf("%s\t%c\t%s\t%c\t%0.4f\t%0.4f\n",
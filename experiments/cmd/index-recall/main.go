@@ -0,0 +1,68 @@
+// index-recall measures the recall of approximate searches that use the
+// index of a BOW database, relative to exact searches, for a range of search
+// budgets. Every entry in the database is used as a query.
+//
+// This is how recall is measured on SABmark: build a BOW database from the
+// chains of a SABmark set (e.g., with the 'sabmark' experiment), index it,
+// and run this command on it. A database without an index is indexed first
+// (which writes the index to the database directory).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/bcbgo/bow"
+)
+
+var (
+	flagLimit = 10
+	flagSeed  = int64(1)
+)
+
+func init() {
+	flag.IntVar(&flagLimit, "limit", flagLimit,
+		"The number of results returned by each search.")
+	flag.Int64Var(&flagSeed, "seed", flagSeed,
+		"The seed used to build an index, if the database has none.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] bow-db\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func main() {
+	db, err := bow.OpenDB(flag.Arg(0))
+	assert(err)
+	if db.Index == nil {
+		assert(db.BuildIndex(flagSeed))
+	}
+
+	fmt.Println("Metric\tBudget\tRecall")
+	for _, metric := range []bow.Metric{bow.Cosine, bow.Euclid} {
+		for _, budget := range []float64{0.05, 0.1, 0.2, 0.3, 0.5, 1} {
+			opts := bow.SearchDefault
+			opts.Limit = flagLimit
+			opts.SortBy = metric
+			opts.Budget = budget
+
+			recall, err := db.MeasureRecall(opts, db.Entries)
+			assert(err)
+			fmt.Printf("%s\t%0.2f\t%0.4f\n", metric.Name(), budget, recall)
+		}
+	}
+	assert(db.Close())
+}
+
+func assert(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+package fragbag
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/TuftsBCB/structure"
+)
+
+// This file provides interoperability with the fragment library format used
+// by the original Fragbag program (written by Rachel Kolodny). These files
+// typically have a '.brk' extension.
+//
+// The format is a subset of the PDB format. Each fragment is a list of
+// alpha-carbon ATOM records, and fragments are separated by TER records.
+// Every fragment in a library must have the same number of atoms.
+
+// OpenBrkFile loads a structure fragment library from the '.brk' file at the
+// path given. The name of the library is the base name of the path.
+func OpenBrkFile(fpath string) (*StructureLibrary, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return OpenBrkLibrary(path.Base(fpath), f)
+}
+
+// OpenBrkLibrary loads a structure fragment library with the given name from
+// the reader provided, which must be in the old Fragbag '.brk' format.
+//
+// The fragment size and number of fragments are inferred from the data. An
+// error is returned if any two fragments have a different number of atoms.
+func OpenBrkLibrary(name string, r io.Reader) (*StructureLibrary, error) {
+	lib := NewStructureLibrary(name)
+	scanner := bufio.NewScanner(r)
+	coords := make([]structure.Coords, 0, 15)
+	var residues []string
+	lineno := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineno++
+
+		switch {
+		case strings.HasPrefix(line, "ATOM"):
+			c, err := readBrkCoords(line)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineno, err)
+			}
+			coords = append(coords, c)
+			residues = append(residues, line[17:20])
+		case strings.HasPrefix(line, "TER"):
+			if len(coords) == 0 {
+				continue
+			}
+			if err := lib.addBrk(coords, residues); err != nil {
+				return nil, err
+			}
+			coords = make([]structure.Coords, 0, lib.FragmentSize)
+			residues = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Be forgiving of a last fragment without a TER record.
+	if len(coords) > 0 {
+		if err := lib.addBrk(coords, residues); err != nil {
+			return nil, err
+		}
+	}
+	if lib.Size() == 0 {
+		return nil, fmt.Errorf("No fragments found in '%s'.", name)
+	}
+	return lib, nil
+}
+
+// addBrk adds a fragment read from a '.brk' file along with the residue
+// names of its atoms.
+func (lib *StructureLibrary) addBrk(
+	coords []structure.Coords,
+	residues []string,
+) error {
+	if err := lib.Add(coords); err != nil {
+		return err
+	}
+	lib.Fragments[len(lib.Fragments)-1].residues = residues
+	return nil
+}
+
+// readBrkCoords reads the x, y and z coordinates from an ATOM record. The
+// coordinates are in the same columns as the PDB format.
+func readBrkCoords(line string) (structure.Coords, error) {
+	if len(line) < 54 {
+		return structure.Coords{},
+			fmt.Errorf("ATOM record '%s' is too short.", line)
+	}
+
+	var xyz [3]float64
+	for i := range xyz {
+		start := 30 + i*8
+		field := strings.TrimSpace(line[start : start+8])
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return structure.Coords{},
+				fmt.Errorf("Could not parse coordinate '%s': %s", field, err)
+		}
+		xyz[i] = f
+	}
+	return structure.Coords{X: xyz[0], Y: xyz[1], Z: xyz[2]}, nil
+}
+
+// SaveBrk writes the fragment library to the writer provided in the old
+// Fragbag '.brk' format. The residue names of a library read from a '.brk'
+// file are kept. Otherwise, residue names aren't known (they aren't stored
+// by Save), so every atom is written as a glycine.
+func (lib *StructureLibrary) SaveBrk(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	serial := 1
+	for _, frag := range lib.Fragments {
+		for i, atom := range frag.Atoms {
+			residue := "GLY"
+			if frag.residues != nil {
+				residue = frag.residues[i]
+			}
+			_, err := fmt.Fprintf(buf,
+				"ATOM  %5d  CA  %s %5d    %8.3f%8.3f%8.3f\n",
+				serial, residue, serial, atom.X, atom.Y, atom.Z)
+			if err != nil {
+				return err
+			}
+			serial++
+		}
+		if _, err := buf.WriteString("TER   \n"); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
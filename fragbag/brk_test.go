@@ -0,0 +1,90 @@
+package fragbag
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+var brkPath = "../data/fraglibs/centers400_11.brk"
+
+func TestBrkRead(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	if lib.Size() != 399 || lib.FragmentSize != 11 {
+		t.Fatalf("Expected library with 399 fragments of size 11, but got "+
+			"%s.", lib)
+	}
+
+	f, err := os.Open("../data/400_11-struct.flib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	flib, err := OpenStructureLibrary(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameCoords(t, flib, lib)
+}
+
+func TestBrkRoundTrip(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := lib.SaveBrk(buf); err != nil {
+		t.Fatal(err)
+	}
+	// The original file is written in the same format, including residue
+	// names, so it's reproduced exactly.
+	original, err := ioutil.ReadFile(brkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), original) {
+		t.Fatalf("Written library differs from '%s'.", brkPath)
+	}
+	lib2, err := OpenBrkLibrary(lib.Name(), buf)
+	if err != nil {
+		t.Fatalf("Could not read written library: %s", err)
+	}
+	assertSameCoords(t, lib, lib2)
+}
+
+func TestBrkInconsistent(t *testing.T) {
+	brk := "" +
+		"ATOM      1  CA  GLY     1       1.000   2.000   3.000\n" +
+		"ATOM      2  CA  GLY     2       4.000   5.000   6.000\n" +
+		"TER   \n" +
+		"ATOM      3  CA  GLY     3       1.000   2.000   3.000\n" +
+		"TER   \n"
+	if _, err := OpenBrkLibrary("bad", strings.NewReader(brk)); err == nil {
+		t.Fatalf("Expected an error for fragments with different lengths.")
+	}
+}
+
+func assertSameCoords(t *testing.T, expected, got *StructureLibrary) {
+	if expected.Size() != got.Size() {
+		t.Fatalf("Expected %d fragments but got %d.",
+			expected.Size(), got.Size())
+	}
+	for i, frag := range expected.Fragments {
+		for j, atom := range frag.Atoms {
+			gatom := got.Fragments[i].Atoms[j]
+			if math.Abs(atom.X-gatom.X) > 1e-3 ||
+				math.Abs(atom.Y-gatom.Y) > 1e-3 ||
+				math.Abs(atom.Z-gatom.Z) > 1e-3 {
+				t.Fatalf("Atom %d of fragment %d differs: %s != %s",
+					j, i, atom, gatom)
+			}
+		}
+	}
+}
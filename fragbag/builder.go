@@ -0,0 +1,314 @@
+package fragbag
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/TuftsBCB/structure"
+)
+
+// StructureBuilder builds a new structure fragment library by clustering
+// every window of alpha-carbon atoms (with length equal to the fragment
+// size) in a set of protein chains. Windows are clustered by RMSD with
+// k-medoids, and the medoid of each cluster becomes a fragment in the
+// library.
+//
+// The zero value is not usable. Use NewStructureBuilder instead.
+type StructureBuilder struct {
+	// The name of the library to build.
+	Name string
+
+	// The number of fragments in the library to build.
+	Size int
+
+	// The number of atoms in each fragment.
+	FragmentSize int
+
+	// The seed used for the random number generator. Two builds with the
+	// same seed and the same input will always produce the same library.
+	Seed int64
+
+	// The maximum number of k-medoids iterations. Clustering stops early if
+	// the medoids stop changing.
+	MaxIterations int
+
+	// When updating the medoid of a cluster, at most this many members of
+	// the cluster (sampled at random) are considered. This keeps the update
+	// step from being quadratic in the size of large clusters.
+	// If MedoidSample is less than 1, every member is considered.
+	MedoidSample int
+
+	windows [][]structure.Coords
+}
+
+// ClusterStats describes a single cluster found while building a fragment
+// library. Its number corresponds to the fragment number in the library.
+type ClusterStats struct {
+	Number int
+
+	// The number of windows assigned to this cluster.
+	Population int
+
+	// The largest RMSD between the fragment and any window in its cluster.
+	Radius float64
+}
+
+func (cs ClusterStats) String() string {
+	return fmt.Sprintf("%d: population %d, radius %0.4f",
+		cs.Number, cs.Population, cs.Radius)
+}
+
+// NewStructureBuilder returns a builder for a structure fragment library
+// with the given name, number of fragments and fragment size. The seed
+// determines all random choices made while clustering.
+func NewStructureBuilder(
+	name string,
+	size, fragSize int,
+	seed int64,
+) *StructureBuilder {
+	return &StructureBuilder{
+		Name:          name,
+		Size:          size,
+		FragmentSize:  fragSize,
+		Seed:          seed,
+		MaxIterations: 50,
+		MedoidSample:  1000,
+	}
+}
+
+// Add adds every window of atoms in the region given as a candidate for
+// clustering. Regions smaller than the fragment size are ignored.
+// As with StructureBower, windows never cross the boundaries of a region.
+//
+// The atoms given are copied.
+func (b *StructureBuilder) Add(atoms []structure.Coords) {
+	if len(atoms) < b.FragmentSize {
+		return
+	}
+	region := make([]structure.Coords, len(atoms))
+	copy(region, atoms)
+	for i := 0; i <= len(region)-b.FragmentSize; i++ {
+		b.windows = append(b.windows, region[i:i+b.FragmentSize])
+	}
+}
+
+// Windows returns the number of windows added to the builder so far.
+func (b *StructureBuilder) Windows() int {
+	return len(b.windows)
+}
+
+// Build clusters all windows added to the builder and returns a new fragment
+// library whose fragments are the cluster medoids, along with statistics
+// for each cluster.
+//
+// An error is returned if there are fewer windows than fragments requested.
+func (b *StructureBuilder) Build() (*StructureLibrary, []ClusterStats, error) {
+	if b.Size < 1 || b.FragmentSize < 1 {
+		return nil, nil, fmt.Errorf("Library size (%d) and fragment size "+
+			"(%d) must be positive.", b.Size, b.FragmentSize)
+	}
+	if len(b.windows) < b.Size {
+		return nil, nil, fmt.Errorf("Cannot build %d fragments from only %d "+
+			"windows.", b.Size, len(b.windows))
+	}
+
+	km := &kmedoids{
+		windows: b.windows,
+		rng:     rand.New(rand.NewSource(b.Seed)),
+		mem:     structure.NewMemory(b.FragmentSize),
+		assign:  make([]int, len(b.windows)),
+		dists:   make([]float64, len(b.windows)),
+	}
+	km.initialize(b.Size)
+	for i := 0; i < b.MaxIterations; i++ {
+		km.assignAll()
+		if !km.update(b.MedoidSample) {
+			break
+		}
+	}
+	km.assignAll()
+
+	lib := NewStructureLibrary(b.Name)
+	stats := make([]ClusterStats, len(km.medoids))
+	for i, m := range km.medoids {
+		if err := lib.Add(b.windows[m]); err != nil {
+			return nil, nil, err
+		}
+		stats[i].Number = i
+	}
+	for w, c := range km.assign {
+		stats[c].Population++
+		if km.dists[w] > stats[c].Radius {
+			stats[c].Radius = km.dists[w]
+		}
+	}
+	return lib, stats, nil
+}
+
+// kmedoids holds the state of a single k-medoids clustering of windows.
+// Medoids are stored as indices into windows.
+type kmedoids struct {
+	windows [][]structure.Coords
+	rng     *rand.Rand
+	mem     structure.Memory
+	medoids []int
+
+	// The cluster of each window and its RMSD to that cluster's medoid.
+	assign []int
+	dists  []float64
+}
+
+func (km *kmedoids) rmsd(w1, w2 int) float64 {
+	return structure.RMSDMem(km.mem, km.windows[w1], km.windows[w2])
+}
+
+// initialize picks k initial medoids with k-means++ seeding. Namely, each
+// subsequent medoid is chosen with probability proportional to the square
+// of its distance to the nearest medoid already chosen.
+func (km *kmedoids) initialize(k int) {
+	n := len(km.windows)
+	nearest := make([]float64, n)
+	km.medoids = []int{km.rng.Intn(n)}
+	for i := range nearest {
+		nearest[i] = km.rmsd(i, km.medoids[0])
+	}
+	for len(km.medoids) < k {
+		total := 0.0
+		for _, d := range nearest {
+			total += d * d
+		}
+
+		next := -1
+		if total > 0 {
+			target := km.rng.Float64() * total
+			for i, d := range nearest {
+				target -= d * d
+				if target <= 0 && d > 0 {
+					next = i
+					break
+				}
+			}
+		}
+		if next == -1 {
+			// Either every window coincides with a medoid or rounding
+			// got in the way. Fall back to any window not yet chosen.
+			next = km.unchosen()
+		}
+		km.medoids = append(km.medoids, next)
+		for i := range nearest {
+			if d := km.rmsd(i, next); d < nearest[i] {
+				nearest[i] = d
+			}
+		}
+	}
+}
+
+// chosen returns the set of windows that are medoids.
+func (km *kmedoids) chosen() map[int]bool {
+	chosen := make(map[int]bool, len(km.medoids))
+	for _, m := range km.medoids {
+		chosen[m] = true
+	}
+	return chosen
+}
+
+// unchosen returns a random window that is not a medoid.
+func (km *kmedoids) unchosen() int {
+	chosen := km.chosen()
+	for {
+		if w := km.rng.Intn(len(km.windows)); !chosen[w] {
+			return w
+		}
+	}
+}
+
+// assignAll assigns every window to its nearest medoid. Ties are broken in
+// favor of the medoid with the lowest fragment number.
+func (km *kmedoids) assignAll() {
+	for w := range km.windows {
+		best, bestDist := -1, 0.0
+		for c, m := range km.medoids {
+			d := km.rmsd(w, m)
+			if best == -1 || d < bestDist {
+				best, bestDist = c, d
+			}
+		}
+		km.assign[w], km.dists[w] = best, bestDist
+	}
+}
+
+// update moves each medoid to the member of its cluster that minimizes the
+// sum of RMSDs to (a sample of) the other members. Empty clusters are
+// reseeded with the window farthest from its medoid, which is then assigned
+// to the reseeded cluster.
+// update returns true if any medoid changed.
+func (km *kmedoids) update(sample int) bool {
+	members := make([][]int, len(km.medoids))
+	for w, c := range km.assign {
+		members[c] = append(members[c], w)
+	}
+
+	changed := false
+	var empty []int
+	for c, ms := range members {
+		if len(ms) == 0 {
+			empty = append(empty, c)
+			continue
+		}
+
+		candidates := ms
+		if sample >= 1 && len(ms) > sample {
+			candidates = make([]int, sample)
+			for i, j := range km.rng.Perm(len(ms))[:sample] {
+				candidates[i] = ms[j]
+			}
+		}
+
+		best, bestCost := km.medoids[c], km.cost(km.medoids[c], candidates)
+		for _, w := range candidates {
+			if cost := km.cost(w, candidates); cost < bestCost {
+				best, bestCost = w, cost
+			}
+		}
+		if best != km.medoids[c] {
+			km.medoids[c] = best
+			changed = true
+		}
+	}
+
+	// Empty clusters are reseeded only after every other medoid has moved,
+	// so that a window is never the medoid of two clusters.
+	for _, c := range empty {
+		far := km.farthest()
+		if far == -1 {
+			// Every window is a medoid.
+			continue
+		}
+		km.medoids[c] = far
+		km.assign[far], km.dists[far] = c, 0
+		changed = true
+	}
+	return changed
+}
+
+// farthest returns the window farthest from its medoid that is not itself a
+// medoid, or -1 if every window is a medoid.
+func (km *kmedoids) farthest() int {
+	chosen := km.chosen()
+	far := -1
+	for w, d := range km.dists {
+		if !chosen[w] && (far == -1 || d > km.dists[far]) {
+			far = w
+		}
+	}
+	return far
+}
+
+// cost returns the sum of RMSDs between the window and the members given.
+func (km *kmedoids) cost(w int, members []int) float64 {
+	sum := 0.0
+	for _, m := range members {
+		sum += km.rmsd(w, m)
+	}
+	return sum
+}
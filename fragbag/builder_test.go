@@ -0,0 +1,76 @@
+package fragbag
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/TuftsBCB/structure"
+)
+
+func TestStructureBuilder(t *testing.T) {
+	src, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+
+	build := func() (*StructureLibrary, []ClusterStats) {
+		b := NewStructureBuilder("test", 10, 7, 42)
+		for _, frag := range src.Fragments[:100] {
+			b.Add(frag.Atoms)
+		}
+		lib, stats, err := b.Build()
+		if err != nil {
+			t.Fatalf("Could not build library: %s", err)
+		}
+		return lib, stats
+	}
+
+	lib, stats := build()
+	if lib.Size() != 10 || lib.FragmentSize != 7 {
+		t.Fatalf("Expected library with 10 fragments of size 7, but got %s.",
+			lib)
+	}
+	population := 0
+	for _, s := range stats {
+		population += s.Population
+	}
+	if population != 100*(11-7+1) {
+		t.Fatalf("Expected %d windows to be clustered, but got %d.",
+			100*(11-7+1), population)
+	}
+
+	lib2, stats2 := build()
+	assertSameCoords(t, lib, lib2)
+	for i := range stats {
+		if stats[i] != stats2[i] {
+			t.Fatalf("Cluster stats differ with the same seed: %s != %s",
+				stats[i], stats2[i])
+		}
+	}
+}
+
+func TestReseedEmptyCluster(t *testing.T) {
+	// Every window is the same, so every window is assigned to the first
+	// medoid and the second cluster is empty.
+	window := []structure.Coords{{X: 0}, {X: 3.8}, {X: 7.6}}
+	km := &kmedoids{
+		windows: [][]structure.Coords{window, window, window, window},
+		rng:     rand.New(rand.NewSource(1)),
+		mem:     structure.NewMemory(len(window)),
+		medoids: []int{0, 1},
+		assign:  make([]int, 4),
+		dists:   make([]float64, 4),
+	}
+	km.assignAll()
+	if !km.update(0) {
+		t.Fatalf("Reseeding an empty cluster did not change its medoid.")
+	}
+	m0, m1 := km.medoids[0], km.medoids[1]
+	if m0 == m1 {
+		t.Fatalf("Clusters 0 and 1 have the same medoid %d.", m0)
+	}
+	if km.assign[m1] != 1 {
+		t.Fatalf("The new medoid %d of cluster 1 is assigned to cluster %d.",
+			m1, km.assign[m1])
+	}
+}
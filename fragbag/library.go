@@ -0,0 +1,54 @@
+package fragbag
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Library describes the methods common to all Fragbag fragment libraries.
+// A fragment library is fixed both in the number of fragments and in the
+// size of each fragment.
+//
+// Values of this interface are either a *StructureLibrary or a
+// *SequenceLibrary.
+type Library interface {
+	// Name returns the name of the library.
+	Name() string
+
+	// Size returns the number of fragments in the library.
+	Size() int
+
+	// FragmentLen returns the size of every fragment in the library.
+	FragmentLen() int
+
+	// String returns a string with the name of the library, the number of
+	// fragments in the library and the size of each fragment.
+	String() string
+
+	// Save saves the full fragment library to the writer provided.
+	// Libraries saved this way may be read back with Open.
+	Save(w io.Writer) error
+}
+
+// Open loads an existing fragment library from the reader provided.
+// The kind of library (structure or sequence) is detected from the
+// serialized data, and the corresponding implementation is returned.
+func Open(r io.Reader) (Library, error) {
+	// The gob encoding of a library starts with a description of its type,
+	// which includes the name of the type. So we peek at the beginning of
+	// the stream to find out which kind of library we have.
+	buf := bufio.NewReader(r)
+	header, err := buf.Peek(64)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	switch {
+	case bytes.Contains(header, []byte("StructureLibrary")):
+		return OpenStructureLibrary(buf)
+	case bytes.Contains(header, []byte("SequenceLibrary")):
+		return OpenSequenceLibrary(buf)
+	}
+	return nil, fmt.Errorf("Could not detect the kind of fragment library.")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/TuftsBCB/seq"
 )
@@ -52,7 +53,8 @@ func (lib *SequenceLibrary) Save(w io.Writer) error {
 	return enc.Encode(*lib)
 }
 
-// Open loads an existing structure fragment library from the reader provided.
+// OpenSequenceLibrary loads an existing sequence fragment library from the
+// reader provided.
 func OpenSequenceLibrary(r io.Reader) (*SequenceLibrary, error) {
 	var lib *SequenceLibrary
 
@@ -75,15 +77,34 @@ func (lib *SequenceLibrary) String() string {
 		lib.Ident, len(lib.Fragments), lib.FragmentSize)
 }
 
+// Name returns the name of the library.
 func (lib *SequenceLibrary) Name() string {
 	return lib.Ident
 }
 
+// FragmentLen returns the size of every fragment in the library.
+func (lib *SequenceLibrary) FragmentLen() int {
+	return lib.FragmentSize
+}
+
 // Best returns the number of the fragment that best corresponds
 // to the string of amino acids provided.
 // The length of `sequence` must be equivalent to the fragment size.
+//
+// The best fragment is the one whose profile gives the sequence the highest
+// probability, i.e., the lowest score. If the library is empty, -1 is
+// returned.
 func (lib *SequenceLibrary) Best(s seq.Sequence) int {
-	panic("unimplemented")
+	var testScore float64
+	bestScore, bestFragNum := 0.0, -1
+	for i := range lib.Fragments {
+		frag := &lib.Fragments[i]
+		testScore = frag.Score(s)
+		if bestFragNum == -1 || testScore < bestScore {
+			bestScore, bestFragNum = testScore, frag.Number
+		}
+	}
+	return bestFragNum
 }
 
 // Fragment corresponds to a single sequence fragment in a fragment library.
@@ -97,6 +118,30 @@ func (frag *SequenceFragment) FragNumber() int {
 	return frag.Number
 }
 
+// Score returns the score of the sequence given with respect to this
+// fragment's profile. Emission probabilities are negative log probabilities,
+// so the score is the sum of the emission probability of each residue in its
+// corresponding column of the profile, and lower scores are better. A residue
+// without an emission probability has a score of +Inf.
+//
+// Score will panic if the length of the sequence is not equal to the number
+// of columns in the profile.
+func (frag *SequenceFragment) Score(s seq.Sequence) float64 {
+	if len(s.Residues) != frag.Len() {
+		panic(fmt.Sprintf("Sequence has length %d, but fragment %d has "+
+			"length %d.", len(s.Residues), frag.Number, frag.Len()))
+	}
+	score := 0.0
+	for i, r := range s.Residues {
+		p, ok := frag.Emissions[i][r]
+		if !ok {
+			return math.Inf(1)
+		}
+		score += float64(p)
+	}
+	return score
+}
+
 func (frag *SequenceFragment) String() string {
 	return fmt.Sprintf("> %d\n%s", frag.Number, frag.Profile)
 }
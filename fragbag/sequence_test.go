@@ -0,0 +1,58 @@
+package fragbag
+
+import (
+	"testing"
+
+	"github.com/TuftsBCB/seq"
+)
+
+// profile returns a profile where each column gives a low score (i.e., a
+// high probability) to the residue at the same position in likely, and a
+// high score to every other residue.
+func profile(likely string) *seq.Profile {
+	prof := &seq.Profile{}
+	for _, r := range likely {
+		probs := seq.EProbs{}
+		for _, other := range "ACDEFG" {
+			probs[seq.Residue(other)] = 3.0
+		}
+		probs[seq.Residue(r)] = 0.1
+		prof.Emissions = append(prof.Emissions, probs)
+	}
+	return prof
+}
+
+func TestSequenceBest(t *testing.T) {
+	lib := NewSequenceLibrary("test")
+	for _, likely := range []string{"AAA", "CDE", "FFG", "CDG"} {
+		if err := lib.Add(profile(likely)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		residues string
+		best     int
+	}{
+		{"AAA", 0},
+		{"CDE", 1},
+		{"FFG", 2},
+		{"CDG", 3},
+		{"CAE", 1},
+		{"FAG", 2},
+		{"AAE", 0},
+	}
+	for _, test := range tests {
+		s := seq.NewSequenceString("test", test.residues)
+		if got := lib.Best(s); got != test.best {
+			t.Fatalf("Best fragment for '%s' is %d but expected %d.",
+				test.residues, got, test.best)
+		}
+	}
+
+	// Residues without an emission probability are never likely.
+	s := seq.NewSequenceString("test", "AAW")
+	if score := lib.Fragments[0].Score(s); score < 1e300 {
+		t.Fatalf("Score of an unknown residue is %f.", score)
+	}
+}
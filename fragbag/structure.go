@@ -4,7 +4,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"math"
 	"strings"
+	"sync"
 
 	"github.com/TuftsBCB/structure"
 )
@@ -31,13 +33,13 @@ func NewStructureLibrary(name string) *StructureLibrary {
 // same number of coordinates as the first.
 func (lib *StructureLibrary) Add(coords []structure.Coords) error {
 	if lib.Fragments == nil || len(lib.Fragments) == 0 {
-		frag := StructureFragment{0, coords}
+		frag := newStructureFragment(0, coords)
 		lib.Fragments = append(lib.Fragments, frag)
 		lib.FragmentSize = len(coords)
 		return nil
 	}
 
-	frag := StructureFragment{len(lib.Fragments), coords}
+	frag := newStructureFragment(len(lib.Fragments), coords)
 	if lib.FragmentSize != len(coords) {
 		return fmt.Errorf("Fragment %d has length %d; expected length %d.",
 			frag.FragNumber(), len(coords), lib.FragmentSize)
@@ -52,7 +54,8 @@ func (lib *StructureLibrary) Save(w io.Writer) error {
 	return enc.Encode(*lib)
 }
 
-// Open loads an existing structure fragment library from the reader provided.
+// OpenStructureLibrary loads an existing structure fragment library from the
+// reader provided.
 func OpenStructureLibrary(r io.Reader) (*StructureLibrary, error) {
 	var lib *StructureLibrary
 
@@ -60,6 +63,12 @@ func OpenStructureLibrary(r io.Reader) (*StructureLibrary, error) {
 	if err := dec.Decode(&lib); err != nil {
 		return nil, err
 	}
+
+	// The centroid distances aren't stored, so compute them now.
+	for i := range lib.Fragments {
+		frag := &lib.Fragments[i]
+		frag.centroidDists = centroidDists(frag.Atoms, nil)
+	}
 	return lib, nil
 }
 
@@ -75,44 +84,216 @@ func (lib *StructureLibrary) String() string {
 		lib.Ident, len(lib.Fragments), lib.FragmentSize)
 }
 
+// Name returns the name of the library.
 func (lib *StructureLibrary) Name() string {
 	return lib.Ident
 }
 
-// rmsdMemory creates reusable memory for use with RMSD calculation with
+// FragmentLen returns the size of every fragment in the library.
+func (lib *StructureLibrary) FragmentLen() int {
+	return lib.FragmentSize
+}
+
+// bestMemory is reusable memory for finding the best fragment of a window
+// of atoms. Only one goroutine can use the memory at a time.
+type bestMemory struct {
+	rmsd  structure.Memory
+	dists []float64
+}
+
+// memory creates reusable memory for use with RMSD calculation with
 // suitable size for this fragment library. Only one goroutine can use the
 // memory at a time.
-func (lib *StructureLibrary) rmsdMemory() structure.Memory {
-	return structure.NewMemory(lib.FragmentSize)
+func (lib *StructureLibrary) memory() bestMemory {
+	return bestMemory{
+		rmsd:  structure.NewMemory(lib.FragmentSize),
+		dists: make([]float64, lib.FragmentSize),
+	}
+}
+
+// bestMemories is a pool of memory used by Best, BestRMSD and BestK, so that
+// finding the best fragment for every window of a structure doesn't allocate.
+// Memory is shared by all libraries, so memory for a different fragment size
+// is discarded.
+var bestMemories sync.Pool
+
+// getMemory returns memory from the pool that is suitable for this fragment
+// library. It should be returned to the pool with putMemory.
+func (lib *StructureLibrary) getMemory() *bestMemory {
+	mem, ok := bestMemories.Get().(*bestMemory)
+	if !ok || len(mem.dists) != lib.FragmentSize {
+		m := lib.memory()
+		mem = &m
+	}
+	return mem
+}
+
+func putMemory(mem *bestMemory) {
+	bestMemories.Put(mem)
 }
 
 // Best returns the number of the fragment that best corresponds
 // to the region of atoms provided.
 // The length of `atoms` must be equivalent to the fragment size.
+//
+// The result is always the same as comparing `atoms` against every fragment
+// in the library (and picking the lowest numbered fragment in case of a
+// tie), but most fragments are ruled out without computing an RMSD.
 func (lib *StructureLibrary) Best(atoms []structure.Coords) int {
-	return lib.bestMem(atoms, lib.rmsdMemory())
+	mem := lib.getMemory()
+	defer putMemory(mem)
+	best, _ := lib.bestMem(atoms, *mem)
+	return best
+}
+
+// BestRMSD is just like Best, except it also returns the RMSD between the
+// region of atoms provided and the best fragment.
+func (lib *StructureLibrary) BestRMSD(
+	atoms []structure.Coords,
+) (int, float64) {
+	mem := lib.getMemory()
+	defer putMemory(mem)
+	return lib.bestMem(atoms, *mem)
 }
 
-// BestMem returns the number of the fragment that best corresponds
-// to the region of atoms provided without allocating.
+// bestEpsilon is the slack given to lower bounds when pruning fragments.
+// It guards against rounding errors making a lower bound slightly larger
+// than the RMSD it bounds.
+const bestEpsilon = 1e-6
+
+// bestMem returns the number of the fragment that best corresponds
+// to the region of atoms provided (along with its RMSD) without allocating.
+// If the library is empty, -1 is returned.
 // The length of `atoms` must be equivalent to the fragment size.
 //
+// Fragments are pruned using a lower bound on the RMSD between two sets of
+// atoms. Namely, superposition cannot change the distance of each atom to
+// the centroid of its set. So by the triangle inequality, the RMSD is at
+// least the root mean square difference between the centroid distances of
+// corresponding atoms. A fragment whose lower bound exceeds the best RMSD
+// found so far cannot be the best fragment.
+//
 // `mem` must be a region of reusable memory that should only be accessed
 // from one goroutine at a time. Valid values can be constructed with
-// rmsdMemory.
+// memory.
 func (lib *StructureLibrary) bestMem(
 	atoms []structure.Coords,
-	mem structure.Memory,
-) int {
+	mem bestMemory,
+) (int, float64) {
+	if len(lib.Fragments) == 0 {
+		return -1, 0
+	}
+	dists := centroidDists(atoms, mem.dists)
+
+	// Start with the fragment with the smallest lower bound, since it's
+	// the most likely to be the best. This makes pruning more effective.
+	first, firstBound := 0, math.Inf(1)
+	for i := range lib.Fragments {
+		bound := lib.Fragments[i].lowerBound(dists)
+		if bound < firstBound {
+			first, firstBound = i, bound
+		}
+	}
+	bestFragNum := lib.Fragments[first].Number
+	bestRmsd := structure.RMSDMem(mem.rmsd, atoms, lib.Fragments[first].Atoms)
+
+	var testRmsd float64
+	for i := range lib.Fragments {
+		frag := &lib.Fragments[i]
+		if i == first || frag.lowerBound(dists) > bestRmsd+bestEpsilon {
+			continue
+		}
+		testRmsd = structure.RMSDMem(mem.rmsd, atoms, frag.Atoms)
+		if testRmsd < bestRmsd ||
+			(testRmsd == bestRmsd && frag.Number < bestFragNum) {
+			bestRmsd, bestFragNum = testRmsd, frag.Number
+		}
+	}
+	return bestFragNum, bestRmsd
+}
+
+// BestK returns the numbers of the `k` fragments that best correspond to
+// the region of atoms provided along with their RMSDs, sorted by RMSD from
+// lowest to highest. Ties are broken by fragment number. If the library has
+// fewer than `k` fragments, every fragment is returned. If `k` is less than
+// 1, nothing is returned.
+// The length of `atoms` must be equivalent to the fragment size.
+func (lib *StructureLibrary) BestK(
+	atoms []structure.Coords,
+	k int,
+) ([]int, []float64) {
+	if k < 1 {
+		return nil, nil
+	}
+	if k > lib.Size() {
+		k = lib.Size()
+	}
+
+	mem := lib.getMemory()
+	defer putMemory(mem)
+	dists := centroidDists(atoms, mem.dists)
+	nums := make([]int, 0, k+1)
+	rmsds := make([]float64, 0, k+1)
+	for i := range lib.Fragments {
+		frag := &lib.Fragments[i]
+		if len(nums) == k &&
+			frag.lowerBound(dists) > rmsds[k-1]+bestEpsilon {
+			continue
+		}
+		rmsd := structure.RMSDMem(mem.rmsd, atoms, frag.Atoms)
+
+		// Insert in sorted order, after any fragment with the same RMSD.
+		j := len(rmsds)
+		for j > 0 && rmsd < rmsds[j-1] {
+			j--
+		}
+		if j >= k {
+			continue
+		}
+		nums = append(nums[:j], append([]int{frag.Number}, nums[j:]...)...)
+		rmsds = append(rmsds[:j], append([]float64{rmsd}, rmsds[j:]...)...)
+		if len(nums) > k {
+			nums, rmsds = nums[:k], rmsds[:k]
+		}
+	}
+	return nums, rmsds
+}
+
+// bestMemBrute is just like bestMem, except it computes the RMSD against
+// every fragment in the library. It is used to check the results and the
+// performance of bestMem.
+func (lib *StructureLibrary) bestMemBrute(
+	atoms []structure.Coords,
+	mem bestMemory,
+) (int, float64) {
 	var testRmsd float64
 	bestRmsd, bestFragNum := 0.0, -1
 	for _, frag := range lib.Fragments {
-		testRmsd = structure.RMSDMem(mem, atoms, frag.Atoms)
+		testRmsd = structure.RMSDMem(mem.rmsd, atoms, frag.Atoms)
 		if bestFragNum == -1 || testRmsd < bestRmsd {
 			bestRmsd, bestFragNum = testRmsd, frag.Number
 		}
 	}
-	return bestFragNum
+	return bestFragNum, bestRmsd
+}
+
+// centroidDists computes the distance of each atom to the centroid of all
+// atoms and stores them in `dists`. If `dists` is nil, it is allocated.
+func centroidDists(atoms []structure.Coords, dists []float64) []float64 {
+	if dists == nil {
+		dists = make([]float64, len(atoms))
+	}
+	var cx, cy, cz float64
+	for _, a := range atoms {
+		cx, cy, cz = cx+a.X, cy+a.Y, cz+a.Z
+	}
+	n := float64(len(atoms))
+	cx, cy, cz = cx/n, cy/n, cz/n
+	for i, a := range atoms {
+		dx, dy, dz := a.X-cx, a.Y-cy, a.Z-cz
+		dists[i] = math.Sqrt(dx*dx + dy*dy + dz*dz)
+	}
+	return dists
 }
 
 // Fragment corresponds to a single structural fragment in a fragment library.
@@ -120,6 +301,36 @@ func (lib *StructureLibrary) bestMem(
 type StructureFragment struct {
 	Number int
 	Atoms  []structure.Coords
+
+	// The distance of each atom to the centroid of Atoms. Used to quickly
+	// rule out fragments when finding the best one. If nil, the fragment
+	// is never ruled out.
+	centroidDists []float64
+
+	// The residue name of each atom, if the fragment was read from a '.brk'
+	// file. Residue names are only used by SaveBrk, and are not saved by
+	// Save.
+	residues []string
+}
+
+func newStructureFragment(
+	number int,
+	atoms []structure.Coords,
+) StructureFragment {
+	return StructureFragment{number, atoms, centroidDists(atoms, nil), nil}
+}
+
+// lowerBound returns a lower bound on the RMSD between this fragment and
+// a set of atoms with the centroid distances given.
+func (frag *StructureFragment) lowerBound(dists []float64) float64 {
+	if frag.centroidDists == nil {
+		return 0
+	}
+	sum := 0.0
+	for i, d := range frag.centroidDists {
+		sum += (d - dists[i]) * (d - dists[i])
+	}
+	return math.Sqrt(sum / float64(len(dists)))
 }
 
 func (frag *StructureFragment) FragNumber() int {
@@ -0,0 +1,146 @@
+package fragbag
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/TuftsBCB/structure"
+)
+
+var samplePaths = []string{
+	"../data/samples/1ctf.pdb",
+	"../data/samples/sample1.pdb",
+	"../data/samples/sample3.pdb",
+}
+
+// sampleWindows returns every window of alpha-carbon atoms with the given
+// size from the sample PDB files.
+func sampleWindows(t testing.TB, size int) [][]structure.Coords {
+	windows := make([][]structure.Coords, 0)
+	for _, fpath := range samplePaths {
+		f, err := os.Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		atoms := make([]structure.Coords, 0)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "ATOM") || line[12:16] != " CA " {
+				continue
+			}
+			c, err := readBrkCoords(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			atoms = append(atoms, c)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i <= len(atoms)-size; i++ {
+			windows = append(windows, atoms[i:i+size])
+		}
+	}
+	return windows
+}
+
+func TestBestPruned(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	mem := lib.memory()
+	for i, window := range sampleWindows(t, lib.FragmentSize) {
+		brute, bruteRmsd := lib.bestMemBrute(window, mem)
+		pruned, prunedRmsd := lib.bestMem(window, mem)
+		if brute != pruned || bruteRmsd != prunedRmsd {
+			t.Fatalf("Window %d: brute force found fragment %d, but pruning "+
+				"found fragment %d.", i, brute, pruned)
+		}
+	}
+}
+
+func TestBestK(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	for i, window := range sampleWindows(t, lib.FragmentSize)[:50] {
+		best, bestRmsd := lib.BestRMSD(window)
+		nums, rmsds := lib.BestK(window, 5)
+		if len(nums) != 5 || nums[0] != best || rmsds[0] != bestRmsd {
+			t.Fatalf("Window %d: expected best fragment %d first, but got "+
+				"%v.", i, best, nums)
+		}
+		for j := 1; j < len(rmsds); j++ {
+			if rmsds[j] < rmsds[j-1] {
+				t.Fatalf("Window %d: RMSDs are not sorted: %v", i, rmsds)
+			}
+		}
+	}
+}
+
+func TestBestKSizes(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	window := sampleWindows(t, lib.FragmentSize)[0]
+	for _, k := range []int{0, -1} {
+		if nums, rmsds := lib.BestK(window, k); nums != nil || rmsds != nil {
+			t.Fatalf("BestK with k = %d returned %v.", k, nums)
+		}
+	}
+	nums, rmsds := lib.BestK(window, lib.Size()+10)
+	if len(nums) != lib.Size() || len(rmsds) != lib.Size() {
+		t.Fatalf("Expected every fragment (%d) but got %d.",
+			lib.Size(), len(nums))
+	}
+}
+
+func TestBestAllocs(t *testing.T) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		t.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	window := sampleWindows(t, lib.FragmentSize)[0]
+	lib.Best(window)
+	allocs := testing.AllocsPerRun(100, func() { lib.Best(window) })
+	if allocs >= 1 {
+		t.Fatalf("Best allocates %f times per call.", allocs)
+	}
+}
+
+func BenchmarkBestBrute(b *testing.B) {
+	benchmarkBest(b, (*StructureLibrary).bestMemBrute)
+}
+
+func BenchmarkBestPruned(b *testing.B) {
+	benchmarkBest(b, (*StructureLibrary).bestMem)
+}
+
+func benchmarkBest(
+	b *testing.B,
+	best func(
+		*StructureLibrary, []structure.Coords, bestMemory) (int, float64),
+) {
+	lib, err := OpenBrkFile(brkPath)
+	if err != nil {
+		b.Fatalf("Could not read '%s': %s", brkPath, err)
+	}
+	windows := sampleWindows(b, lib.FragmentSize)
+	mem := lib.memory()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, window := range windows {
+			best(lib, window, mem)
+		}
+	}
+}